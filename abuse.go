@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Lafeng/ezgoo/glog"
+)
+
+const (
+	abuseSorry   = "sorry"
+	abuseLimited = "429"
+	abuseCaptcha = "captcha"
+)
+
+type AbuseConfig struct {
+	// how long a blocked egress address is avoided
+	BlockTime time.Duration
+	// serve a page leading to the CAPTCHA instead of the upstream block
+	Interstitial bool
+}
+
+func defaultAbuseConfig() AbuseConfig {
+	return AbuseConfig{
+		BlockTime:    30 * time.Minute,
+		Interstitial: true,
+	}
+}
+
+type egressState struct {
+	index        int // names the egress in the metrics
+	blocks       int64
+	lastBlock    time.Time
+	blockedUntil time.Time
+}
+
+// AbuseTracker records the upstream blocks by egress address, the local
+// address of the upstream connection.
+type AbuseTracker struct {
+	mu     sync.Mutex
+	egress map[string]*egressState
+	// the last egress seen of ipv4 and ipv6
+	family [2]string
+	// the blocked egress of the clients solving the CAPTCHA
+	pins map[string]egressPin
+}
+
+type egressPin struct {
+	egress string
+	until  time.Time
+}
+
+var (
+	abuseTracker = &AbuseTracker{egress: make(map[string]*egressState)}
+	abuseMetrics = newMetricsMap("abuse")
+)
+
+func ipFamily(ip string) int {
+	if strings.IndexByte(ip, ':') >= 0 {
+		return 1
+	}
+	return 0
+}
+
+// Seen records the egress of an upstream connection
+func (t *AbuseTracker) Seen(egress string) {
+	t.mu.Lock()
+	t.family[ipFamily(egress)] = egress
+	t.mu.Unlock()
+}
+
+// Report records a block of egress
+func (t *AbuseTracker) Report(egress, kind string, now time.Time) {
+	if egress == NULL {
+		egress = "unknown"
+	}
+	t.mu.Lock()
+	e := t.egress[egress]
+	if e == nil {
+		e = &egressState{index: len(t.egress) + 1}
+		t.egress[egress] = e
+	}
+	e.blocks++
+	e.lastBlock = now
+	e.blockedUntil = now.Add(config.abuse.BlockTime)
+	blocks, index := e.blocks, e.index
+	t.mu.Unlock()
+
+	// the metrics may be public, the address is only logged
+	abuseMetrics.Add(kind, 1)
+	abuseMetrics.Add(fmt.Sprintf("egress #%d", index), 1)
+	log.Warningf("Upstream blocked egress=%s (#%d) kind=%s blocks=%d", egress, index, kind, blocks)
+	// stop reusing the connections of the blocked egress
+	if tr, y := http_client.Transport.(interface{ CloseIdleConnections() }); y {
+		tr.CloseIdleConnections()
+	}
+}
+
+// Clear marks egress healthy again, e.g. the CAPTCHA was solved
+func (t *AbuseTracker) Clear(egress string) {
+	t.mu.Lock()
+	if e := t.egress[egress]; e != nil {
+		e.blockedUntil = time.Time{}
+	}
+	t.mu.Unlock()
+	abuseMetrics.Add("solved", 1)
+}
+
+// Pin sends the sorry pages of the client session from the blocked
+// egress, the CAPTCHA is only accepted from the address it was shown to.
+func (t *AbuseTracker) Pin(session, egress string, now time.Time) {
+	if egress == NULL {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pins == nil {
+		t.pins = make(map[string]egressPin)
+	}
+	for k, p := range t.pins {
+		if !now.Before(p.until) {
+			delete(t.pins, k)
+		}
+	}
+	t.pins[session] = egressPin{egress, now.Add(config.abuse.BlockTime)}
+}
+
+func (t *AbuseTracker) Unpin(session string) {
+	t.mu.Lock()
+	delete(t.pins, session)
+	t.mu.Unlock()
+}
+
+// Pinned returns the egress pinned for the client session, empty if none.
+func (t *AbuseTracker) Pinned(session string, now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, y := t.pins[session]; y && now.Before(p.until) {
+		return p.egress
+	}
+	return NULL
+}
+
+func (t *AbuseTracker) Blocked(egress string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.egress[egress]
+	return e != nil && now.Before(e.blockedUntil)
+}
+
+// LastBlock returns when egress was blocked last, zero if never.
+func (t *AbuseTracker) LastBlock(egress string) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e := t.egress[egress]; e != nil {
+		return e.lastBlock
+	}
+	return time.Time{}
+}
+
+// familyBlocked reports whether the last egress of the family of ip is blocked
+func (t *AbuseTracker) familyBlocked(ip net.IP, now time.Time) bool {
+	var f = 0
+	if ip.To4() == nil {
+		f = 1
+	}
+	t.mu.Lock()
+	egress := t.family[f]
+	t.mu.Unlock()
+	return egress != NULL && t.Blocked(egress, now)
+}
+
+// dialUpstream dials the addresses of the families whose egress is not
+// blocked first, then those of the family preferred by Egress.IPv6.
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	pref := config.egress.ipv6Preference(host)
+	rank := func(ip net.IP) int {
+		var r = 0
+		if abuseTracker.familyBlocked(ip, now) {
+			r = 2
+		}
+		if v6 := ip.To4() == nil; pref == ipv6Prefer && !v6 || pref == ipv6Avoid && v6 {
+			r++
+		}
+		return r
+	}
+	sort.SliceStable(ips, func(a, b int) bool {
+		return rank(ips[a].IP) < rank(ips[b].IP)
+	})
+	var conn net.Conn
+	for _, ip := range ips {
+		conn, err = baseDialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+type egressPinKey struct{}
+
+// withEgressPin binds the sorry page requests of the client session to
+// its pinned egress
+func withEgressPin(req *http.Request, session string) *http.Request {
+	if !strings.HasPrefix(req.URL.Path, "/sorry") {
+		return req
+	}
+	egress := abuseTracker.Pinned(session, time.Now())
+	if egress == NULL {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), egressPinKey{}, egress))
+}
+
+func pinnedEgress(req *http.Request) string {
+	egress, _ := req.Context().Value(egressPinKey{}).(string)
+	return egress
+}
+
+// pinnedTransport sends each pinned request on a new connection bound to
+// the pinned egress, an idle connection could be of another one.
+var pinnedTransport = &http.Transport{
+	Proxy:               nil,
+	DialContext:         dialPinned,
+	TLSHandshakeTimeout: 5 * time.Second,
+	DisableKeepAlives:   true,
+}
+
+func dialPinned(ctx context.Context, network, addr string) (net.Conn, error) {
+	egress, _ := ctx.Value(egressPinKey{}).(string)
+	ip := net.ParseIP(egress)
+	if ip == nil {
+		return dialUpstream(ctx, network, addr)
+	}
+	dialer := *baseDialer
+	dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	if network = "tcp4"; ip.To4() == nil {
+		network = "tcp6"
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// upstreamTransport is the transport without egress pool, the pinned
+// requests go by pinnedTransport.
+type upstreamTransport struct {
+	*http.Transport
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if pinnedEgress(req) != NULL {
+		return pinnedTransport.RoundTrip(req)
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+// traceEgress records the local address of the connection of req into egress
+func traceEgress(req *http.Request, egress *string) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, y := info.Conn.LocalAddr().(*net.TCPAddr); y {
+				*egress = addr.IP.String()
+				abuseTracker.Seen(*egress)
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// detectAbuse returns the kind of the upstream block of resp, empty if none.
+func detectAbuse(resp *http.Response) string {
+	if resp == nil {
+		return NULL
+	}
+	if strings.HasPrefix(resp.Request.URL.Path, "/sorry") {
+		if resp.StatusCode == 429 || resp.StatusCode == 503 {
+			return abuseCaptcha
+		}
+		return NULL
+	}
+	if loc := resp.Header.Get("Location"); loc != NULL && strings.Contains(loc, "/sorry/") {
+		return abuseSorry
+	}
+	if resp.StatusCode == 429 {
+		return abuseLimited
+	}
+	return NULL
+}
+
+// captchaSolved reports the redirection leaving the sorry page
+func captchaSolved(resp *http.Response) bool {
+	if resp == nil || !strings.HasPrefix(resp.Request.URL.Path, "/sorry/") {
+		return false
+	}
+	loc := resp.Header.Get("Location")
+	return loc != NULL && !strings.Contains(loc, "/sorry/")
+}
+
+const interstitial_response = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Blocked</title></head>
+<body style="font-family:sans-serif;max-width:40em;margin:4em auto">
+<h2>Google has temporarily blocked this proxy</h2>
+<p>Too many requests were sent from the address of this proxy.</p>
+<p>%s<a href="%s">Try again</a></p>
+</body></html>
+`
+
+// serveInterstitial writes the page leading to the CAPTCHA for the
+// navigation requests, the location is the mapped sorry page.
+func (s *Session) serveInterstitial(w http.ResponseWriter, accept, location string) bool {
+	if !config.abuse.Interstitial || s.aMethod != "GET" || !strings.Contains(accept, "text/html") {
+		return false
+	}
+	var solve string
+	if location != NULL {
+		solve = fmt.Sprintf(`<a href="%s">Solve the CAPTCHA</a> or `, html.EscapeString(location))
+	}
+	h := w.Header()
+	for k := range h {
+		if k != "Set-Cookie" {
+			delete(h, k)
+		}
+	}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	h.Set("Retry-After", fmt.Sprint(int(config.abuse.BlockTime/time.Second)))
+	w.WriteHeader(503)
+	fmt.Fprintf(w, interstitial_response, solve, html.EscapeString(s.uri))
+	return true
+}
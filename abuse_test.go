@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectAbuse(t *testing.T) {
+	samples := []struct {
+		path     string
+		status   int
+		location string
+		kind     string
+	}{
+		{"/search", 302, "https://www.google.com/sorry/index?continue=x", abuseSorry},
+		{"/search", 429, NULL, abuseLimited},
+		{"/sorry/index", 429, NULL, abuseCaptcha},
+		{"/sorry/index", 302, "https://www.google.com/search?q=1", NULL},
+		{"/search", 200, NULL, NULL},
+	}
+	for _, sa := range samples {
+		u, _ := url.Parse("https://www.google.com" + sa.path)
+		resp := &http.Response{StatusCode: sa.status, Header: make(http.Header), Request: &http.Request{URL: u}}
+		if sa.location != NULL {
+			resp.Header.Set("Location", sa.location)
+		}
+		if kind := detectAbuse(resp); kind != sa.kind {
+			t.Errorf("path=%s status=%d kind=%s", sa.path, sa.status, kind)
+		}
+		if solved := captchaSolved(resp); solved != (sa.path == "/sorry/index" && sa.status == 302) {
+			t.Errorf("path=%s status=%d solved=%v", sa.path, sa.status, solved)
+		}
+	}
+}
+
+func TestAbuseTracker(t *testing.T) {
+	config = new(AppConfig)
+	config.abuse = defaultAbuseConfig()
+	tr := &AbuseTracker{egress: make(map[string]*egressState)}
+	now := time.Now()
+	tr.Seen("192.0.2.1")
+	tr.Seen("2001:db8::1")
+	tr.Report("192.0.2.1", abuseSorry, now)
+	if !tr.Blocked("192.0.2.1", now) || tr.Blocked("192.0.2.1", now.Add(time.Hour)) || tr.Blocked("2001:db8::1", now) {
+		t.Errorf("blocked state")
+	}
+	if !tr.familyBlocked(net.ParseIP("198.51.100.1"), now) || tr.familyBlocked(net.ParseIP("2001:db8::2"), now) {
+		t.Errorf("family state")
+	}
+	if tr.LastBlock("192.0.2.1") != now {
+		t.Errorf("last block")
+	}
+	if abuseMetrics.Get("egress #1") == nil || strings.Contains(abuseMetrics.String(), "192.0.2.1") {
+		t.Errorf("metrics %s", abuseMetrics)
+	}
+	tr.Clear("192.0.2.1")
+	if tr.Blocked("192.0.2.1", now) {
+		t.Errorf("not cleared")
+	}
+}
+
+func TestServeInterstitial(t *testing.T) {
+	config = new(AppConfig)
+	config.abuse = defaultAbuseConfig()
+	s := &Session{aMethod: "GET", uri: "/search?q=<x>"}
+	w := httptest.NewRecorder()
+	w.Header().Set("Location", "/sorry/index")
+	w.Header().Set("Set-Cookie", "ezgoo_sid=1")
+	if s.serveInterstitial(w, "application/json", "/sorry/index") {
+		t.Errorf("served to xhr")
+	}
+	if !s.serveInterstitial(w, "text/html,*/*", "/sorry/index?continue=a&q=b") {
+		t.Fatal("not served")
+	}
+	body := w.Body.String()
+	if w.Code != 503 || w.Header().Get("Location") != NULL || w.Header().Get("Set-Cookie") == NULL ||
+		!strings.Contains(body, `href="/sorry/index?continue=a&amp;q=b"`) || !strings.Contains(body, "q=&lt;x&gt;") {
+		t.Errorf("code=%d header=%v body=%s", w.Code, w.Header(), body)
+	}
+}
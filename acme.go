@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Lafeng/ezgoo/glog"
+)
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+type ACMEConfig struct {
+	Enabled bool
+	// directory of the CA, e.g. the staging one of letsencrypt
+	// https://acme-staging-v02.api.letsencrypt.org/directory
+	DirectoryURL string
+	Email        string
+	// the names of the certificate, the first one names the files
+	Domains []string
+	// http-01 needs a plaintext listener at port 80,
+	// tls-alpn-01 needs an ACME listener at port 443
+	Challenge string
+	// the account key and the certificates are stored in Dir,
+	// relative to the config dir
+	Dir string
+	// the certificate is renewed RenewBefore its expiry,
+	// it's checked every CheckInterval
+	RenewBefore   time.Duration
+	CheckInterval time.Duration
+	// PEM file of the roots trusted for DirectoryURL, e.g. of a test CA,
+	// empty means the system roots
+	RootCAs string
+}
+
+func defaultACMEConfig() ACMEConfig {
+	return ACMEConfig{
+		DirectoryURL:  "https://acme-v02.api.letsencrypt.org/directory",
+		Challenge:     acmeHTTP01,
+		Dir:           "acme",
+		RenewBefore:   30 * 24 * time.Hour,
+		CheckInterval: 12 * time.Hour,
+	}
+}
+
+func (c *ACMEConfig) init() error {
+	c.Domains = trimList(c.Domains)
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Domains) < 1 {
+		return fmt.Errorf("ACME.Domains: no domain was specified")
+	}
+	switch c.Challenge {
+	case acmeHTTP01, acmeTLSALPN01:
+	default:
+		return fmt.Errorf("ACME.Challenge: unknown value %q", c.Challenge)
+	}
+	if u, err := url.Parse(c.DirectoryURL); err != nil || u.Host == NULL {
+		return fmt.Errorf("ACME.DirectoryURL: invalid url %q", c.DirectoryURL)
+	}
+	if c.CheckInterval <= 0 {
+		c.CheckInterval = 12 * time.Hour
+	}
+	return nil
+}
+
+// ACMEManager obtains the certificate of the ACME listeners and renews it
+// ahead of its expiry.
+type ACMEManager struct {
+	conf   *ACMEConfig
+	client *acmeClient
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	// http-01 token => key authorization
+	tokens map[string]string
+	// tls-alpn-01 domain => challenge certificate
+	alpnCerts map[string]*tls.Certificate
+	stop      chan bool
+}
+
+var acmeManager *ACMEManager
+
+func NewACMEManager(conf *ACMEConfig) (*ACMEManager, error) {
+	if err := os.MkdirAll(conf.Dir, 0700); err != nil {
+		return nil, err
+	}
+	key, err := loadAccountKey(filepath.Join(conf.Dir, "account.key"))
+	if err != nil {
+		return nil, err
+	}
+	var transport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if conf.RootCAs != NULL {
+		data, err := ioutil.ReadFile(conf.RootCAs)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("ACME.RootCAs: no certificate in %s", conf.RootCAs)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	m := &ACMEManager{
+		conf:      conf,
+		client:    newAcmeClient(conf.DirectoryURL, key, &http.Client{Transport: transport, Timeout: 30 * time.Second}),
+		tokens:    make(map[string]string),
+		alpnCerts: make(map[string]*tls.Certificate),
+		stop:      make(chan bool),
+	}
+	cert, err := m.loadCertificate()
+	if err == nil {
+		err = m.install(&cert)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Warningf("ACME: ignored the stored certificate: %v", err)
+	}
+	return m, nil
+}
+
+// loadAccountKey reads the account key of file, a new one is generated
+// and saved if it doesn't exist.
+func loadAccountKey(file string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data", file)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeECKey(file, key); err != nil {
+		return nil, err
+	}
+	log.Infof("ACME: generated the account key %s", file)
+	return key, nil
+}
+
+func encodeECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func writeECKey(file string, key *ecdsa.PrivateKey) error {
+	data, err := encodeECKey(key)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0600)
+}
+
+func (m *ACMEManager) certFile(ext string) string {
+	return filepath.Join(m.conf.Dir, m.conf.Domains[0]+ext)
+}
+
+// loadCertificate reads the stored certificate, the chain and the key are
+// in <domain>.pem, or in <domain>.crt and .key of the earlier versions.
+func (m *ACMEManager) loadCertificate() (tls.Certificate, error) {
+	data, err := ioutil.ReadFile(m.certFile(".pem"))
+	if os.IsNotExist(err) {
+		return tls.LoadX509KeyPair(m.certFile(".crt"), m.certFile(".key"))
+	}
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(data, data)
+}
+
+func (m *ACMEManager) install(cert *tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+	log.Infof("ACME: certificate of %s expires at %s", strings.Join(leaf.DNSNames, ","), leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// needsRenewal is true if there is no certificate, or it's expiring within
+// RenewBefore, or it doesn't cover the configured domains.
+func (m *ACMEManager) needsRenewal(now time.Time) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return true
+	}
+	leaf := m.cert.Leaf
+	for _, d := range m.conf.Domains {
+		if leaf.VerifyHostname(d) != nil {
+			return true
+		}
+	}
+	return !now.Add(m.conf.RenewBefore).Before(leaf.NotAfter)
+}
+
+// renew obtains a new certificate and stores it in Dir
+func (m *ACMEManager) renew() error {
+	if m.client.kid == NULL {
+		if err := m.client.register(m.conf.Email); err != nil {
+			return err
+		}
+	}
+	chain, key, err := m.client.obtain(m.conf.Domains, m.conf.Challenge, m)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return err
+	}
+	// one file replaced at once, a crash can't leave a key of another chain
+	data := append(bytes.TrimRight(chain, "\n"), '\n')
+	data = append(data, keyPEM...)
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return err
+	}
+	file := m.certFile(".pem")
+	if err = ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+	return m.install(&cert)
+}
+
+// maintain renews the certificate when due, a failed renewal is retried
+// after a minute the first time and at CheckInterval later.
+func (m *ACMEManager) maintain() {
+	var retry = time.Minute
+	for {
+		var wait = m.conf.CheckInterval
+		if m.needsRenewal(time.Now()) {
+			if err := m.renew(); err != nil {
+				log.Warningf("ACME: renewal failed: %v", err)
+				wait, retry = retry, m.conf.CheckInterval
+			} else {
+				retry = time.Minute
+			}
+		}
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (m *ACMEManager) Start() {
+	go m.maintain()
+}
+
+func (m *ACMEManager) Close() error {
+	close(m.stop)
+	return nil
+}
+
+func (m *ACMEManager) present(typ, domain, token, keyAuth string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if typ == acmeHTTP01 {
+		m.tokens[token] = keyAuth
+		return nil
+	}
+	cert, err := alpnChallengeCert(domain, keyAuth)
+	if err != nil {
+		return err
+	}
+	m.alpnCerts[domain] = cert
+	return nil
+}
+
+func (m *ACMEManager) cleanup(typ, domain, token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if typ == acmeHTTP01 {
+		delete(m.tokens, token)
+	} else {
+		delete(m.alpnCerts, domain)
+	}
+}
+
+// GetCertificate answers the tls-alpn-01 challenges and serves the
+// obtained certificate otherwise.
+func (m *ACMEManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acmeALPNProto {
+		if cert := m.alpnCerts[strings.ToLower(hello.ServerName)]; cert != nil {
+			return cert, nil
+		}
+		return nil, fmt.Errorf("ACME: no challenge for %s", hello.ServerName)
+	}
+	if m.cert == nil {
+		return nil, fmt.Errorf("ACME: no certificate yet")
+	}
+	return m.cert, nil
+}
+
+// serveChallenge answers the http-01 challenges
+func (s *Session) serveChallenge(w http.ResponseWriter, req *http.Request) bool {
+	if acmeManager == nil || !strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+		return false
+	}
+	acmeManager.mu.RLock()
+	keyAuth, y := acmeManager.tokens[req.URL.Path[len(acmeChallengePath):]]
+	acmeManager.mu.RUnlock()
+	if !y {
+		http.NotFound(w, req)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+	return true
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeACME is a minimal ACME server, it validates the challenges
+// against the http and tls addresses of the client.
+type fakeACME struct {
+	t        *testing.T
+	srv      *httptest.Server
+	httpAddr string
+	tlsAddr  string
+	validity time.Duration
+	caKey    *ecdsa.PrivateKey
+	caCert   *x509.Certificate
+
+	mu       sync.Mutex
+	nonces   map[string]bool
+	seq      int
+	accounts map[string]*ecdsa.PublicKey
+	thumbs   map[string]string
+	authz    map[string]string // domain => status
+	typ      map[string]string // domain => validated challenge type
+	order    string
+	cert     []byte
+	badNonce bool // reject the next order with badNonce
+	orders   int
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	f := &fakeACME{
+		t:        t,
+		validity: 90 * 24 * time.Hour,
+		nonces:   make(map[string]bool),
+		accounts: make(map[string]*ecdsa.PublicKey),
+		thumbs:   make(map[string]string),
+		authz:    make(map[string]string),
+		typ:      make(map[string]string),
+	}
+	f.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake acme ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tpl, tpl, f.caKey.Public(), f.caKey)
+	f.caCert, _ = x509.ParseCertificate(der)
+	f.srv = httptest.NewTLSServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeACME) url(path string) string {
+	return f.srv.URL + path
+}
+
+// rootsFile writes the root of the fake server for ACME.RootCAs
+func (f *fakeACME) rootsFile(dir string) string {
+	file := filepath.Join(dir, "roots.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.srv.Certificate().Raw})
+	ioutil.WriteFile(file, data, 0644)
+	return file
+}
+
+func (f *fakeACME) newNonce(w http.ResponseWriter) {
+	f.seq++
+	nonce := fmt.Sprintf("nonce-%d", f.seq)
+	f.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+func (f *fakeACME) problem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + typ, "detail": detail})
+}
+
+func (f *fakeACME) reply(w http.ResponseWriter, status int, location string, v interface{}) {
+	if location != NULL {
+		w.Header().Set("Location", f.url(location))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// verify checks the JWS of the request and returns the account and payload
+func (f *fakeACME) verify(req *http.Request) (account string, payload []byte, err error) {
+	var jws struct{ Protected, Payload, Signature string }
+	if err = json.NewDecoder(req.Body).Decode(&jws); err != nil {
+		return
+	}
+	data, _ := b64.DecodeString(jws.Protected)
+	var header struct {
+		Alg, Nonce, URL, Kid string
+		Jwk                  map[string]string
+	}
+	if err = json.Unmarshal(data, &header); err != nil {
+		return
+	}
+	if header.Alg != "ES256" || header.URL != f.url(req.URL.Path) {
+		return NULL, nil, fmt.Errorf("bad header %s", data)
+	}
+	if !f.nonces[header.Nonce] {
+		return NULL, nil, errBadNonce
+	}
+	delete(f.nonces, header.Nonce)
+	var pub *ecdsa.PublicKey
+	if header.Kid != NULL {
+		account, pub = header.Kid, f.accounts[header.Kid]
+	} else if header.Jwk != nil {
+		x, _ := b64.DecodeString(header.Jwk["x"])
+		y, _ := b64.DecodeString(header.Jwk["y"])
+		pub = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		canonical := fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, header.Jwk["x"], header.Jwk["y"])
+		sum := sha256.Sum256([]byte(canonical))
+		account = f.url("/acct/" + b64.EncodeToString(sum[:8]))
+		f.accounts[account] = pub
+		f.thumbs[account] = b64.EncodeToString(sum[:])
+	}
+	sig, _ := b64.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if pub == nil || len(sig) != 64 ||
+		!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return NULL, nil, fmt.Errorf("bad signature")
+	}
+	payload, err = b64.DecodeString(jws.Payload)
+	return
+}
+
+var errBadNonce = fmt.Errorf("bad nonce")
+
+func (f *fakeACME) serve(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.newNonce(w)
+	path := req.URL.Path
+	switch {
+	case path == "/dir":
+		f.reply(w, 200, NULL, map[string]string{
+			"newNonce":   f.url("/nonce"),
+			"newAccount": f.url("/acct"),
+			"newOrder":   f.url("/order"),
+		})
+		return
+	case path == "/nonce":
+		return
+	}
+	account, payload, err := f.verify(req)
+	if err == errBadNonce {
+		f.problem(w, 400, "badNonce", "stale nonce")
+		return
+	} else if err != nil {
+		f.problem(w, 400, "malformed", err.Error())
+		return
+	}
+	switch {
+	case path == "/acct":
+		f.reply(w, 201, account[len(f.srv.URL):], map[string]string{"status": "valid"})
+	case path == "/order":
+		if f.badNonce {
+			f.badNonce = false
+			f.problem(w, 400, "badNonce", "forced")
+			return
+		}
+		var order struct {
+			Identifiers []struct{ Value string }
+		}
+		json.Unmarshal(payload, &order)
+		f.orders++
+		var authz []string
+		for _, id := range order.Identifiers {
+			if f.authz[id.Value] == NULL {
+				f.authz[id.Value] = "pending"
+			}
+			authz = append(authz, f.url("/authz/"+id.Value))
+		}
+		f.order = "pending"
+		f.reply(w, 201, "/order/1", f.orderJSON(authz))
+	case strings.HasPrefix(path, "/authz/"):
+		domain := path[len("/authz/"):]
+		f.reply(w, 200, NULL, map[string]interface{}{
+			"status":     f.authz[domain],
+			"identifier": map[string]string{"type": "dns", "value": domain},
+			"challenges": []map[string]string{
+				{"type": acmeHTTP01, "url": f.url("/chal/http/" + domain), "token": "h-" + domain},
+				{"type": acmeTLSALPN01, "url": f.url("/chal/alpn/" + domain), "token": "t-" + domain},
+			},
+		})
+	case strings.HasPrefix(path, "/chal/"):
+		parts := strings.SplitN(path[len("/chal/"):], "/", 2)
+		if err := f.validate(parts[0], parts[1], f.thumbs[account]); err != nil {
+			f.authz[parts[1]] = acmeStatusInvalid
+			f.t.Logf("challenge %s of %s: %v", parts[0], parts[1], err)
+		} else {
+			f.authz[parts[1]] = acmeStatusValid
+			f.typ[parts[1]] = parts[0]
+		}
+		f.reply(w, 200, NULL, map[string]string{"status": "processing"})
+	case path == "/finalize/1":
+		var body struct{ CSR string }
+		json.Unmarshal(payload, &body)
+		der, _ := b64.DecodeString(body.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			f.problem(w, 400, "badCSR", err.Error())
+			return
+		}
+		f.issue(csr)
+		f.order = "processing"
+		f.reply(w, 200, NULL, f.orderJSON(nil))
+	case path == "/order/1":
+		f.order = acmeStatusValid
+		f.reply(w, 200, NULL, f.orderJSON(nil))
+	case path == "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(f.cert)
+	default:
+		f.problem(w, 404, "malformed", path)
+	}
+}
+
+func (f *fakeACME) orderJSON(authz []string) map[string]interface{} {
+	order := map[string]interface{}{
+		"status":         f.order,
+		"authorizations": authz,
+		"finalize":       f.url("/finalize/1"),
+	}
+	if f.order == acmeStatusValid {
+		order["certificate"] = f.url("/cert/1")
+	}
+	return order
+}
+
+func (f *fakeACME) validate(typ, domain, thumb string) error {
+	var keyAuth string
+	if typ == "http" {
+		keyAuth = "h-" + domain + "." + thumb
+		resp, err := http.Get("http://" + f.httpAddr + acmeChallengePath + "h-" + domain)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != 200 || string(body) != keyAuth {
+			return fmt.Errorf("status %d body %q", resp.StatusCode, body)
+		}
+		return nil
+	}
+	keyAuth = "t-" + domain + "." + thumb
+	conn, err := tls.Dial("tcp", f.tlsAddr, &tls.Config{
+		ServerName:         domain,
+		NextProtos:         []string{acmeALPNProto},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != acmeALPNProto {
+		return fmt.Errorf("protocol %q", state.NegotiatedProtocol)
+	}
+	leaf := state.PeerCertificates[0]
+	sum := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(asn1.ObjectIdentifier(oidAcmeIdentifier)) {
+			var value []byte
+			asn1.Unmarshal(ext.Value, &value)
+			if ext.Critical && bytes.Equal(value, sum[:]) && leaf.VerifyHostname(domain) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no acmeIdentifier")
+}
+
+func (f *fakeACME) issue(csr *x509.CertificateRequest) {
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(f.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, f.caCert, csr.PublicKey, f.caKey)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...)
+}
+
+// startACME runs a manager of conf with the challenge listeners of f
+func startACME(t *testing.T, f *fakeACME, conf *ACMEConfig) *ACMEManager {
+	m, err := NewACMEManager(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.client.pollInterval = 10 * time.Millisecond
+	acmeManager = m
+
+	challenges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !new(Session).serveChallenge(w, req) {
+			w.WriteHeader(500)
+		}
+	}))
+	t.Cleanup(challenges.Close)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = tls.NewListener(ln, &tls.Config{GetCertificate: m.GetCertificate, NextProtos: []string{"http/1.1", acmeALPNProto}})
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	f.httpAddr = challenges.Listener.Addr().String()
+	f.tlsAddr = ln.Addr().String()
+	return m
+}
+
+func testACMEConfig(t *testing.T, f *fakeACME, typ string) *ACMEConfig {
+	dir, err := ioutil.TempDir(NULL, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	conf := defaultACMEConfig()
+	conf.Enabled = true
+	conf.DirectoryURL = f.url("/dir")
+	conf.Domains = []string{"a.example.com", "b.example.com"}
+	conf.Challenge = typ
+	conf.Dir = filepath.Join(dir, "acme")
+	conf.RootCAs = f.rootsFile(dir)
+	if err = conf.init(); err != nil {
+		t.Fatal(err)
+	}
+	return &conf
+}
+
+func TestACMEIssue(t *testing.T) {
+	defer func() { acmeManager = nil }()
+	for _, typ := range []string{acmeHTTP01, acmeTLSALPN01} {
+		f := newFakeACME(t)
+		defer f.srv.Close()
+		f.badNonce = true
+		conf := testACMEConfig(t, f, typ)
+		m := startACME(t, f, conf)
+		if !m.needsRenewal(time.Now()) {
+			t.Fatalf("%s: no certificate needs no renewal", typ)
+		}
+		if err := m.renew(); err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+		want := map[string]string{acmeHTTP01: "http", acmeTLSALPN01: "alpn"}[typ]
+		for _, d := range conf.Domains {
+			if f.typ[d] != want {
+				t.Errorf("%s: %s validated by %q", typ, d, f.typ[d])
+			}
+		}
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com", SupportedProtos: []string{"http/1.1"}})
+		if err != nil || cert.Leaf.VerifyHostname("b.example.com") != nil {
+			t.Fatalf("%s: GetCertificate %v", typ, err)
+		}
+		if len(m.tokens) != 0 || len(m.alpnCerts) != 0 {
+			t.Errorf("%s: challenges not cleaned up", typ)
+		}
+		for _, name := range []string{"account.key", "a.example.com.pem"} {
+			if _, err := os.Stat(filepath.Join(conf.Dir, name)); err != nil {
+				t.Errorf("%s: %v", typ, err)
+			}
+		}
+	}
+}
+
+func TestACMERenewal(t *testing.T) {
+	defer func() { acmeManager = nil }()
+	f := newFakeACME(t)
+	defer f.srv.Close()
+	f.validity = 10 * 24 * time.Hour
+	conf := testACMEConfig(t, f, acmeHTTP01)
+	m := startACME(t, f, conf)
+	if err := m.renew(); err != nil {
+		t.Fatal(err)
+	}
+	var now = time.Now()
+	if m.needsRenewal(now.Add(-30 * 24 * time.Hour)) {
+		t.Errorf("renewal long before expiry")
+	}
+	if !m.needsRenewal(now) {
+		t.Errorf("no renewal within RenewBefore of expiry")
+	}
+	conf.RenewBefore = 24 * time.Hour
+	if m.needsRenewal(now) {
+		t.Errorf("renewal ahead of RenewBefore")
+	}
+
+	// the stored account key and certificate are reused
+	key := m.client.key
+	serial := m.cert.Leaf.SerialNumber
+	m2 := startACME(t, f, conf)
+	if !m2.client.key.Equal(key) {
+		t.Errorf("account key not reused")
+	}
+	if m2.cert == nil || m2.cert.Leaf.SerialNumber.Cmp(serial) != 0 {
+		t.Fatalf("stored certificate not loaded")
+	}
+
+	// the certificate pair of the earlier versions
+	pemFile := filepath.Join(conf.Dir, "a.example.com.pem")
+	data, err := ioutil.ReadFile(pemFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{".crt", ".key"} {
+		if err = ioutil.WriteFile(filepath.Join(conf.Dir, "a.example.com"+ext), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Remove(pemFile)
+	if m3, err := NewACMEManager(conf); err != nil || m3.cert == nil || m3.cert.Leaf.SerialNumber.Cmp(serial) != 0 {
+		t.Errorf("certificate pair not loaded: %v", err)
+	}
+
+	conf.Domains = append(conf.Domains, "c.example.com")
+	if !m2.needsRenewal(now) {
+		t.Errorf("no renewal of a certificate missing a domain")
+	}
+	if err := m2.renew(); err != nil {
+		t.Fatal(err)
+	}
+	if f.orders != 2 || m2.cert.Leaf.VerifyHostname("c.example.com") != nil {
+		t.Errorf("orders %d, names %v", f.orders, m2.cert.Leaf.DNSNames)
+	}
+}
+
+func TestACMEConfig(t *testing.T) {
+	var samples = []struct {
+		conf ACMEConfig
+		err  string
+	}{
+		{ACMEConfig{}, NULL},
+		{ACMEConfig{Enabled: true, Challenge: acmeHTTP01, DirectoryURL: "https://ca/dir"}, "no domain"},
+		{ACMEConfig{Enabled: true, Domains: []string{"a"}, Challenge: "dns-01", DirectoryURL: "https://ca/dir"}, "unknown value"},
+		{ACMEConfig{Enabled: true, Domains: []string{"a"}, Challenge: acmeHTTP01, DirectoryURL: "dir"}, "invalid url"},
+		{ACMEConfig{Enabled: true, Domains: []string{"a"}, Challenge: acmeTLSALPN01, DirectoryURL: "https://ca/dir"}, NULL},
+	}
+	for i, sa := range samples {
+		err := sa.conf.init()
+		if (err == nil) != (sa.err == NULL) || err != nil && !strings.Contains(err.Error(), sa.err) {
+			t.Errorf("sample %d: %v, want %q", i, err, sa.err)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	acmeHTTP01    = "http-01"
+	acmeTLSALPN01 = "tls-alpn-01"
+	acmeALPNProto = "acme-tls/1"
+
+	acmeStatusValid   = "valid"
+	acmeStatusInvalid = "invalid"
+)
+
+var b64 = base64.RawURLEncoding
+
+// acmeClient speaks the ACME protocol of RFC 8555 to a CA directory
+type acmeClient struct {
+	dirURL string
+	key    *ecdsa.PrivateKey
+	kid    string // account url
+	client *http.Client
+	nonce  string
+	dir    struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+	// interval and count of the status polls
+	pollInterval time.Duration
+	pollCount    int
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	status int
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("acme: %d %s: %s", p.status, p.Type, p.Detail)
+}
+
+type acmeOrder struct {
+	url            string
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeChallenge struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+}
+
+type acmeAuthz struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+// acmeSolver prepares and cleans up the response of a challenge
+type acmeSolver interface {
+	present(typ, domain, token, keyAuth string) error
+	cleanup(typ, domain, token string)
+}
+
+func newAcmeClient(dirURL string, key *ecdsa.PrivateKey, client *http.Client) *acmeClient {
+	return &acmeClient{
+		dirURL:       dirURL,
+		key:          key,
+		client:       client,
+		pollInterval: time.Second,
+		pollCount:    60,
+	}
+}
+
+func (c *acmeClient) discover() error {
+	resp, err := c.client.Get(c.dirURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("acme: directory %s status %s", c.dirURL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(&c.dir)
+}
+
+func (c *acmeClient) fetchNonce() (string, error) {
+	if nonce := c.nonce; nonce != NULL {
+		c.nonce = NULL
+		return nonce, nil
+	}
+	resp, err := c.client.Head(c.dir.NewNonce)
+	if err != nil {
+		return NULL, err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == NULL {
+		return NULL, fmt.Errorf("acme: no nonce")
+	}
+	return nonce, nil
+}
+
+func (c *acmeClient) jwk() map[string]string {
+	size := (c.key.Curve.Params().BitSize + 7) / 8
+	return map[string]string{
+		"crv": c.key.Curve.Params().Name,
+		"kty": "EC",
+		"x":   b64.EncodeToString(padBytes(c.key.X.Bytes(), size)),
+		"y":   b64.EncodeToString(padBytes(c.key.Y.Bytes(), size)),
+	}
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// thumbprint is the JWK thumbprint of RFC 7638 of the account key
+func (c *acmeClient) thumbprint() string {
+	jwk := c.jwk()
+	// the required members in lexical order
+	data := fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, jwk["crv"], jwk["x"], jwk["y"])
+	sum := sha256.Sum256([]byte(data))
+	return b64.EncodeToString(sum[:])
+}
+
+func (c *acmeClient) keyAuthorization(token string) string {
+	return token + "." + c.thumbprint()
+}
+
+// signJWS returns the flattened JWS of payload, nil payload is the
+// POST-as-GET.
+func (c *acmeClient) signJWS(url, nonce string, payload interface{}) ([]byte, error) {
+	var header = map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": nonce,
+		"url":   url,
+	}
+	if c.kid == NULL {
+		header["jwk"] = c.jwk()
+	} else {
+		header["kid"] = c.kid
+	}
+	protected, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	var body string
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = b64.EncodeToString(data)
+	}
+	input := b64.EncodeToString(protected) + "." + body
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := append(padBytes(r.Bytes(), 32), padBytes(s.Bytes(), 32)...)
+	return json.Marshal(map[string]string{
+		"protected": b64.EncodeToString(protected),
+		"payload":   body,
+		"signature": b64.EncodeToString(sig),
+	})
+}
+
+// post sends the signed payload to url and decodes the json response
+// into out, a bad nonce is retried once.
+func (c *acmeClient) post(url string, payload, out interface{}) (resp *http.Response, body []byte, err error) {
+	for retry := 0; retry < 2; retry++ {
+		var nonce string
+		if nonce, err = c.fetchNonce(); err != nil {
+			return
+		}
+		var jws []byte
+		if jws, err = c.signJWS(url, nonce, payload); err != nil {
+			return
+		}
+		resp, err = c.client.Post(url, "application/jose+json", bytes.NewReader(jws))
+		if err != nil {
+			return
+		}
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+		c.nonce = resp.Header.Get("Replay-Nonce")
+		if resp.StatusCode < 400 {
+			if out != nil && strings.Contains(resp.Header.Get("Content-Type"), "json") {
+				err = json.Unmarshal(body, out)
+			}
+			return
+		}
+		var problem = &acmeProblem{status: resp.StatusCode}
+		json.Unmarshal(body, problem)
+		err = problem
+		if problem.Type != "urn:ietf:params:acme:error:badNonce" {
+			return
+		}
+	}
+	return
+}
+
+// register creates the account of the key or finds the existing one
+func (c *acmeClient) register(email string) error {
+	if err := c.discover(); err != nil {
+		return err
+	}
+	var account = map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != NULL {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	resp, _, err := c.post(c.dir.NewAccount, account, nil)
+	if err != nil {
+		return err
+	}
+	if c.kid = resp.Header.Get("Location"); c.kid == NULL {
+		return fmt.Errorf("acme: no account url")
+	}
+	return nil
+}
+
+// obtain orders a certificate of domains by solving the challenges of typ,
+// and returns the PEM chain and the private key of the certificate.
+func (c *acmeClient) obtain(domains []string, typ string, solver acmeSolver) (chain []byte, key *ecdsa.PrivateKey, err error) {
+	var ids []map[string]string
+	for _, d := range domains {
+		ids = append(ids, map[string]string{"type": "dns", "value": d})
+	}
+	var order acmeOrder
+	resp, _, err := c.post(c.dir.NewOrder, map[string]interface{}{"identifiers": ids}, &order)
+	if err != nil {
+		return
+	}
+	order.url = resp.Header.Get("Location")
+	for _, url := range order.Authorizations {
+		if err = c.authorize(url, typ, solver); err != nil {
+			return
+		}
+	}
+
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return
+	}
+	if _, _, err = c.post(order.Finalize, map[string]string{"csr": b64.EncodeToString(csr)}, &order); err != nil {
+		return
+	}
+	for i := 0; order.Status != acmeStatusValid; i++ {
+		if order.Status == acmeStatusInvalid || i >= c.pollCount {
+			return nil, nil, fmt.Errorf("acme: order %s status %s", order.url, order.Status)
+		}
+		time.Sleep(c.pollInterval)
+		if _, _, err = c.post(order.url, nil, &order); err != nil {
+			return
+		}
+	}
+	_, chain, err = c.post(order.Certificate, nil, nil)
+	return
+}
+
+func (c *acmeClient) authorize(url, typ string, solver acmeSolver) error {
+	var authz acmeAuthz
+	if _, _, err := c.post(url, nil, &authz); err != nil {
+		return err
+	}
+	if authz.Status == acmeStatusValid {
+		return nil
+	}
+	var chal *acmeChallenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == typ {
+			chal = &authz.Challenges[i]
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("acme: no %s challenge for %s", typ, authz.Identifier.Value)
+	}
+	domain := authz.Identifier.Value
+	if err := solver.present(typ, domain, chal.Token, c.keyAuthorization(chal.Token)); err != nil {
+		return err
+	}
+	defer solver.cleanup(typ, domain, chal.Token)
+	if _, _, err := c.post(chal.URL, struct{}{}, nil); err != nil {
+		return err
+	}
+	for i := 0; authz.Status != acmeStatusValid; i++ {
+		if authz.Status == acmeStatusInvalid || i >= c.pollCount {
+			return fmt.Errorf("acme: authorization of %s status %s", domain, authz.Status)
+		}
+		time.Sleep(c.pollInterval)
+		if _, _, err := c.post(url, nil, &authz); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the id-pe-acmeIdentifier extension of RFC 8737
+var oidAcmeIdentifier = []int{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// alpnChallengeCert returns the self-signed certificate answering the
+// tls-alpn-01 challenge of domain.
+func alpnChallengeCert(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	// an ASN.1 OCTET STRING of the digest
+	value := append([]byte{0x04, byte(len(sum))}, sum[:]...)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidAcmeIdentifier, Critical: true, Value: value},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: crypto.Signer(key)}, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Lafeng/ezgoo/glog"
+)
+
+// certFiles is a certificate and its key file, they're the same file
+// if the key is in the certificate file.
+type certFiles struct {
+	cert string
+	key  string
+}
+
+// parseCertFiles parses the entries of TlsCertificates, "cert.pem key.pem"
+// or "both.pem".
+func parseCertFiles(entries []string) ([]certFiles, error) {
+	var files []certFiles
+	for _, e := range trimList(entries) {
+		switch f := strings.Fields(e); len(f) {
+		case 1:
+			files = append(files, certFiles{f[0], f[0]})
+		case 2:
+			files = append(files, certFiles{f[0], f[1]})
+		default:
+			return nil, fmt.Errorf("expected \"cert key\" or \"file\", got %q", e)
+		}
+	}
+	return files, nil
+}
+
+type certEntry struct {
+	files  certFiles
+	stamp  string // the sizes and mtimes of the files
+	cert   *tls.Certificate
+	warned time.Time // the last expiry warning
+}
+
+// CertStore holds the certificates of a TLS listener and selects them by
+// the SNI of the client, the first one is served without a match.
+type CertStore struct {
+	name    string
+	mu      sync.RWMutex
+	entries []*certEntry
+	byName  map[string]*tls.Certificate
+}
+
+func NewCertStore(name string, files []certFiles) (*CertStore, error) {
+	s := &CertStore{name: name}
+	for _, f := range files {
+		e := &certEntry{files: f, stamp: fileStamp(f)}
+		cert, err := loadCertificate(f)
+		if err != nil {
+			return nil, err
+		}
+		e.cert = cert
+		s.entries = append(s.entries, e)
+	}
+	if len(s.entries) < 1 {
+		return nil, fmt.Errorf("no certificate was specified")
+	}
+	s.index()
+	return s, nil
+}
+
+func loadCertificate(f certFiles) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(f.cert, f.key)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// fileStamp changes when any file of f is rewritten
+func fileStamp(f certFiles) string {
+	var stamp string
+	for _, name := range []string{f.cert, f.key} {
+		if fi, err := os.Stat(name); err == nil {
+			stamp += fmt.Sprintf("%d@%d;", fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return stamp
+}
+
+// certNames returns the names of the certificate, the CN only counts
+// without the SANs.
+func certNames(leaf *x509.Certificate) []string {
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames
+	}
+	if leaf.Subject.CommonName != NULL {
+		return []string{leaf.Subject.CommonName}
+	}
+	return nil
+}
+
+// index maps the names to the certificates, the earlier one wins
+func (s *CertStore) index() {
+	var byName = make(map[string]*tls.Certificate)
+	for _, e := range s.entries {
+		for _, name := range certNames(e.cert.Leaf) {
+			name = strings.ToLower(name)
+			if byName[name] == nil {
+				byName[name] = e.cert
+			}
+		}
+	}
+	s.byName = byName
+}
+
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert := s.byName[name]; cert != nil {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert := s.byName["*"+name[i:]]; cert != nil {
+			return cert, nil
+		}
+	}
+	return s.entries[0].cert, nil
+}
+
+// reload reloads the certificates whose files have changed, a certificate
+// failed to load is kept until the files change again.
+func (s *CertStore) reload() {
+	var changed bool
+	for _, e := range s.entries {
+		stamp := fileStamp(e.files)
+		if stamp == e.stamp {
+			continue
+		}
+		e.stamp = stamp
+		cert, err := loadCertificate(e.files)
+		if err != nil {
+			log.Warningf("Listener %s: keeps the certificate of %s: %v", s.name, e.files.cert, err)
+			continue
+		}
+		s.mu.Lock()
+		e.cert, e.warned = cert, time.Time{}
+		s.mu.Unlock()
+		changed = true
+		log.Infof("Listener %s: reloaded %s, expires at %s", s.name, e.files.cert, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	if changed {
+		s.mu.Lock()
+		s.index()
+		s.mu.Unlock()
+	}
+}
+
+// warnExpiry logs the certificates expiring within before, once a day each
+func (s *CertStore) warnExpiry(now time.Time, before time.Duration) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, e := range s.entries {
+		leaf := e.cert.Leaf
+		if now.Add(before).Before(leaf.NotAfter) || now.Sub(e.warned) < 24*time.Hour {
+			continue
+		}
+		e.warned = now
+		if now.After(leaf.NotAfter) {
+			log.Warningf("Listener %s: the certificate %s expired at %s", s.name, e.files.cert, leaf.NotAfter.Format(time.RFC3339))
+		} else {
+			log.Warningf("Listener %s: the certificate %s expires at %s", s.name, e.files.cert, leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+}
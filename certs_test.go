@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate of names to dir/file.crt
+// and its key to dir/file.key, both to dir/file.pem if combined.
+func writeTestCert(t *testing.T, dir, file string, notAfter time.Time, combined bool, names ...string) certFiles {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	var f = certFiles{filepath.Join(dir, file+".crt"), filepath.Join(dir, file+".key")}
+	if combined {
+		f.cert = filepath.Join(dir, file+".pem")
+		f.key = f.cert
+		certPem = append(certPem, keyPem...)
+	} else {
+		ioutil.WriteFile(f.key, keyPem, 0600)
+	}
+	ioutil.WriteFile(f.cert, certPem, 0644)
+	return f
+}
+
+func TestParseCertFiles(t *testing.T) {
+	files, err := parseCertFiles([]string{" a.crt  a.key", "b.pem", ""})
+	if err != nil || len(files) != 2 || files[0] != (certFiles{"a.crt", "a.key"}) || files[1] != (certFiles{"b.pem", "b.pem"}) {
+		t.Errorf("files=%v err=%v", files, err)
+	}
+	if _, err = parseCertFiles([]string{"a b c"}); err == nil {
+		t.Errorf("accepted 3 files")
+	}
+}
+
+func TestCertStore(t *testing.T) {
+	dir, err := ioutil.TempDir(NULL, "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	expiry := time.Now().Add(90 * 24 * time.Hour)
+	a := writeTestCert(t, dir, "a", expiry, false, "a.example.com")
+	b := writeTestCert(t, dir, "b", expiry, true, "*.b.example.com", "b.example.com")
+	s, err := NewCertStore("test", []certFiles{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(name string) string {
+		cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Leaf.DNSNames[0]
+	}
+	for name, expected := range map[string]string{
+		"a.example.com":     "a.example.com",
+		"B.example.com.":    "*.b.example.com",
+		"www.b.example.com": "*.b.example.com",
+		"x.y.b.example.com": "a.example.com",
+		"":                  "a.example.com",
+	} {
+		if got := serve(name); got != expected {
+			t.Errorf("%q served %s, want %s", name, got, expected)
+		}
+	}
+
+	// a rewritten file is reloaded, a broken one keeps the old certificate
+	a2 := writeTestCert(t, dir, "a", expiry, false, "a.example.com", "c.example.com")
+	os.Chtimes(a2.cert, time.Now(), time.Now().Add(time.Second))
+	s.reload()
+	if serve("c.example.com") != "a.example.com" || serve("www.b.example.com") != "*.b.example.com" {
+		t.Errorf("not reloaded")
+	}
+	ioutil.WriteFile(b.cert, []byte("broken"), 0644)
+	s.reload()
+	if serve("b.example.com") != "*.b.example.com" {
+		t.Errorf("broken certificate replaced the old one")
+	}
+
+	if _, err = NewCertStore("test", []certFiles{{"missing.crt", "missing.key"}}); err == nil {
+		t.Errorf("loaded a missing certificate")
+	}
+}
+
+func TestCertStoreExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir(NULL, "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	soon := writeTestCert(t, dir, "soon", now.Add(48*time.Hour), true, "soon.example.com")
+	later := writeTestCert(t, dir, "later", now.Add(90*24*time.Hour), true, "later.example.com")
+	s, err := NewCertStore("test", []certFiles{soon, later})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.warnExpiry(now, 7*24*time.Hour)
+	if !s.entries[0].warned.Equal(now) || !s.entries[1].warned.IsZero() {
+		t.Errorf("warned %v %v", s.entries[0].warned, s.entries[1].warned)
+	}
+	// once a day
+	s.warnExpiry(now.Add(time.Hour), 7*24*time.Hour)
+	if !s.entries[0].warned.Equal(now) {
+		t.Errorf("warned again within a day")
+	}
+	s.warnExpiry(now.Add(25*time.Hour), 7*24*time.Hour)
+	if !s.entries[0].warned.Equal(now.Add(25 * time.Hour)) {
+		t.Errorf("not warned the next day")
+	}
+}
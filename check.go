@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/spance/ipatrie"
+)
+
+// configSection describes a section of config.ini, structs returns the
+// structs the section is mapped to, nil for the sections of free keys.
+type configSection struct {
+	name    string
+	structs func(c *AppConfig, section string) []interface{}
+	// the keys accepted besides the fields of the structs
+	dynamic func(key string) bool
+}
+
+func mapped(v ...interface{}) []interface{} {
+	return v
+}
+
+// the sections in the order of the effective configuration,
+// Listener stands for the listener sections, HeaderPolicy and Routes for their children.
+var configSchema = []*configSection{
+	{name: "Basic", structs: func(c *AppConfig, _ string) []interface{} { return mapped(c) }},
+	{name: "Listener", structs: func(c *AppConfig, section string) []interface{} {
+		s := c.listener(section)
+		return mapped(s, &s.clientRestriction)
+	}},
+	{name: "DomainRestriction", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.domainRestrictions) }},
+	{name: "ClientRestriction", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.clientRestrictions) }},
+	{name: "HeaderPolicy", structs: func(c *AppConfig, section string) []interface{} {
+		for _, hp := range c.headerPolicies {
+			if hp.Name == section {
+				return mapped(hp)
+			}
+		}
+		return mapped(new(HeaderPolicy))
+	}, dynamic: headerPolicyKey},
+	{name: "SecurityHeaders", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.securityHeaders) }},
+	{name: "Privacy", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.privacy) }},
+	{name: "ParamRewrite", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.paramRewrite) }},
+	{name: "Redirect", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.redirect) }},
+	{name: "PrefDom", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.prefDom) }},
+	{name: "Abuse", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.abuse) }},
+	{name: "Egress", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.egress) }},
+	{name: "Redirector", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.redirector) }},
+	{name: "TLS", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.tls) }},
+	{name: "ACME", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.acme) }},
+	{name: "Routes"},
+	{name: "Metrics", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.metrics) }},
+	{name: "RuleGroups"},
+	{name: "CookieJar", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.cookieJar) }},
+	{name: "CookieCrypto", structs: func(c *AppConfig, _ string) []interface{} { return mapped(&c.cookieCrypto) }},
+}
+
+// the values never printed
+var secretKeys = map[string]bool{
+	"CookieCrypto.Keys": true,
+}
+
+// listener returns the listener of the section, an empty one if disabled
+func (c *AppConfig) listener(section string) *AppServ {
+	for _, s := range c.servers {
+		if s.section == section {
+			return s
+		}
+	}
+	return &AppServ{section: section}
+}
+
+// headerPolicyKey reports the dynamic keys of the header policies,
+// e.g. RequestSet.X-Client
+func headerPolicyKey(name string) bool {
+	for _, phase := range []string{"Request", "Response"} {
+		for _, action := range []string{"Set", "Add", "Rewrite"} {
+			if strings.HasPrefix(name, phase+action+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func lookupSection(name string) *configSection {
+	if _, y := listenerName(name); y {
+		name = "Listener"
+	} else if strings.HasPrefix(name, "HeaderPolicy.") {
+		name = "HeaderPolicy"
+	} else if strings.HasPrefix(name, routesPrefix) {
+		name = "Routes"
+	}
+	for _, sec := range configSchema {
+		if sec.name == name {
+			return sec
+		}
+	}
+	return nil
+}
+
+// keys returns the fields of the section, nil for the free keys
+func (sec *configSection) keys() []iniField {
+	if sec.structs == nil {
+		return nil
+	}
+	var fields []iniField
+	for _, v := range sec.structs(new(AppConfig), sec.name) {
+		fields = append(fields, iniFields(v)...)
+	}
+	return fields
+}
+
+// known reports whether key is a key of the section
+func (sec *configSection) known(key string) bool {
+	if sec.structs == nil || sec.dynamic != nil && sec.dynamic(key) {
+		return true
+	}
+	for _, f := range sec.keys() {
+		if f.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+type iniField struct {
+	key   string
+	value reflect.Value
+	delim string
+}
+
+// iniFields returns the fields of the struct v mapped by MapTo
+func iniFields(v interface{}) []iniField {
+	var fields []iniField
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		tag := f.Tag.Get("ini")
+		if f.PkgPath != NULL || tag == "-" {
+			continue
+		}
+		var field = iniField{key: f.Name, value: rv.Field(i), delim: f.Tag.Get("delim")}
+		if tag != NULL {
+			field.key = tag
+		}
+		if field.delim == NULL {
+			field.delim = ","
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func (f iniField) String() string {
+	switch v := f.value.Interface().(type) {
+	case []string:
+		sep := f.delim
+		if sep == "," {
+			sep = ", "
+		}
+		return strings.Join(v, sep)
+	case time.Duration:
+		return v.String()
+	}
+	return fmt.Sprint(f.value.Interface())
+}
+
+// iniLine is a key or a section header of config.ini
+type iniLine struct {
+	line    int
+	section string
+	key     string // empty for the section header
+	value   string
+	source  string // the environment variable or -set of an override
+}
+
+// scanIni reads the sections and keys of an ini file with their line
+// numbers, go-ini doesn't keep them.
+func scanIni(data []byte) []iniLine {
+	var lines []iniLine
+	var section = ini.DEFAULT_SECTION
+	var quoted bool
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(scanner.Text())
+		if quoted {
+			// the rest of a multi-line backtick value
+			quoted = strings.IndexByte(text, '`') < 0
+			continue
+		}
+		if text == NULL || text[0] == '#' || text[0] == ';' {
+			continue
+		}
+		if text[0] == '[' {
+			section = strings.TrimSpace(strings.Trim(text, "[]"))
+			lines = append(lines, iniLine{line: n, section: section})
+			continue
+		}
+		i := strings.IndexAny(text, "=:")
+		if i < 0 {
+			lines = append(lines, iniLine{line: n, section: section, key: text})
+			continue
+		}
+		value := strings.TrimSpace(text[i+1:])
+		if strings.HasPrefix(value, "`") {
+			quoted = strings.Count(value, "`") < 2
+		} else if j := strings.IndexAny(value, "#;"); j >= 0 {
+			value = strings.TrimSpace(value[:j])
+		}
+		lines = append(lines, iniLine{line: n, section: section, key: strings.TrimSpace(text[:i]), value: value})
+	}
+	return lines
+}
+
+type configChecker struct {
+	file   string
+	issues []*LintIssue
+}
+
+func (c *configChecker) report(line int, format string, args ...interface{}) {
+	c.issues = append(c.issues, &LintIssue{File: c.file, Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// reportAt reports the problem of l, at its source if it's an override
+func (c *configChecker) reportAt(l iniLine, format string, args ...interface{}) {
+	if l.source == NULL {
+		c.report(l.line, format, args...)
+	} else {
+		c.issues = append(c.issues, &LintIssue{File: l.source, Msg: fmt.Sprintf(format, args...)})
+	}
+}
+
+// checkKeys reports the unknown sections and keys, and returns the line
+// of each section.key and the listener sections in order.
+func (c *configChecker) checkKeys(lines []iniLine) (map[string]iniLine, []string) {
+	var known = make(map[string]iniLine)
+	var listeners []string
+	for _, l := range lines {
+		if _, y := listenerName(l.section); y && !containsString(listeners, l.section) {
+			listeners = append(listeners, l.section)
+		}
+		sec := lookupSection(l.section)
+		if sec == nil {
+			if l.key == NULL || l.source != NULL {
+				c.reportAt(l, "unknown section [%s]", l.section)
+			} else if l.section == ini.DEFAULT_SECTION {
+				c.report(l.line, "key %s outside of any section", l.key)
+			}
+			continue
+		}
+		if l.key == NULL {
+			continue
+		}
+		if !sec.known(l.key) {
+			c.reportAt(l, "unknown key %s in [%s]", l.key, l.section)
+		}
+		known[l.section+"."+l.key] = l
+	}
+	return known, listeners
+}
+
+// checkValues reports the problems which are only warned at startup or
+// are reported without the line.
+func (c *configChecker) checkValues(known map[string]iniLine, listeners []string) {
+	for _, section := range append([]string{"ClientRestriction"}, listeners...) {
+		if l, y := known[section+".Addresses"]; y {
+			for _, cidr := range trimList(strings.Split(l.value, ",")) {
+				if _, _, err := ipatrie.ParseCIDR(cidr); err != nil {
+					c.reportAt(l, "%s.Addresses: invalid CIDR %q: %v", section, cidr, err)
+				}
+			}
+		}
+	}
+	if l, y := known["Metrics.Addresses"]; y {
+		for _, cidr := range trimList(strings.Split(l.value, ",")) {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				c.reportAt(l, "Metrics.Addresses: invalid CIDR %q", cidr)
+			}
+		}
+	}
+	for _, section := range listeners {
+		if known[section+".Listen"].value == NULL {
+			continue
+		}
+		cert, key := known[section+".TlsCertificate"], known[section+".TlsCertificateKey"]
+		more := known[section+".TlsCertificates"]
+		if strings.EqualFold(known[section+".ACME"].value, "true") {
+			continue
+		}
+		if section == "HTTPS.Server" && more.value == NULL || cert.value != NULL || key.value != NULL {
+			c.checkPem(section, "TlsCertificate", cert)
+			c.checkPem(section, "TlsCertificateKey", key)
+		}
+		files, err := parseCertFiles(strings.Split(more.value, ","))
+		if err != nil {
+			c.reportAt(more, "%s.TlsCertificates: %v", section, err)
+		}
+		for _, f := range files {
+			l := more
+			l.value = f.cert
+			c.checkPem(section, "TlsCertificates", l)
+			if f.key != f.cert {
+				l.value = f.key
+				c.checkPem(section, "TlsCertificates", l)
+			}
+		}
+	}
+	c.checkPorts(known, listeners)
+}
+
+// checkPem reports the certificate files which can't be read or have
+// no PEM block.
+func (c *configChecker) checkPem(section, key string, l iniLine) {
+	if l.value == NULL {
+		c.reportAt(l, "%s.%s: not specified", section, key)
+		return
+	}
+	data, err := ioutil.ReadFile(l.value)
+	if err != nil {
+		c.reportAt(l, "%s.%s: %v", section, key, err)
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		c.reportAt(l, "%s.%s: no PEM data in %s", section, key, l.value)
+		return
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			c.reportAt(l, "%s.%s: %v", section, key, err)
+		} else if time.Now().After(cert.NotAfter) {
+			c.reportAt(l, "%s.%s: expired at %s", section, key, cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+}
+
+// checkPorts reports the listen addresses which can't be parsed or
+// share a port.
+func (c *configChecker) checkPorts(known map[string]iniLine, listeners []string) {
+	var bound []iniLine
+	for _, section := range listeners {
+		l := known[section+".Listen"]
+		if l.value == NULL {
+			continue
+		}
+		host, port, err := net.SplitHostPort(l.value)
+		if err != nil {
+			c.reportAt(l, "%s.Listen: %v", section, err)
+			continue
+		}
+		for _, prev := range bound {
+			prevHost, prevPort, _ := net.SplitHostPort(prev.value)
+			if port == prevPort && (host == prevHost || wildcardHost(host) || wildcardHost(prevHost)) {
+				c.reportAt(l, "%s.Listen: %s conflicts with %s.Listen %s", section, l.value, prev.section, prev.value)
+			}
+		}
+		bound = append(bound, l)
+	}
+}
+
+func wildcardHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == NULL || ip != nil && ip.IsUnspecified()
+}
+
+// printConfig writes the effective configuration of conf, the free keys
+// are printed as they are in cfg.
+func printConfig(w io.Writer, cfg *ini.File, conf *AppConfig) {
+	for _, sec := range configSchema {
+		var sections = []string{sec.name}
+		switch sec.name {
+		case "Listener":
+			sections = sections[:0]
+			for _, s := range conf.servers {
+				sections = append(sections, s.section)
+			}
+		case "HeaderPolicy":
+			sections = sections[:0]
+			for _, hp := range conf.headerPolicies {
+				sections = append(sections, hp.Name)
+			}
+		case "Routes":
+			for _, s := range cfg.Sections() {
+				if strings.HasPrefix(s.Name(), routesPrefix) {
+					sections = append(sections, s.Name())
+				}
+			}
+		}
+		for _, name := range sections {
+			fmt.Fprintf(w, "[%s]\n", name)
+			if sec.structs != nil {
+				for _, v := range sec.structs(conf, name) {
+					printFields(w, sec.name, v)
+				}
+			}
+			for _, key := range cfg.Section(name).Keys() {
+				if sec.structs == nil || sec.dynamic != nil && sec.dynamic(key.Name()) {
+					fmt.Fprintf(w, "%s = %s\n", key.Name(), key.Value())
+				}
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+func printFields(w io.Writer, section string, v interface{}) {
+	for _, f := range iniFields(v) {
+		value := f.String()
+		if secretKeys[section+"."+f.key] && value != NULL {
+			value = "<hidden>"
+		}
+		fmt.Fprintf(w, "%s = %s\n", f.key, value)
+	}
+}
+
+// checkConfig loads config.ini and rules.xml of the working directory
+// and returns the problems found, conf is nil if the config can't be loaded.
+func checkConfig() (issues []*LintIssue, cfg *ini.File, conf *AppConfig) {
+	var c = &configChecker{file: "config.ini"}
+	data, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		c.report(0, "%v", err)
+		return c.issues, nil, nil
+	}
+	var lines = scanIni(data)
+	if cfg, err = ini.Load(data); err != nil {
+		c.report(0, "%v", err)
+	} else {
+		overrides, unknown, err := configOverrides(cfg, os.Environ(), config_sets, listen)
+		if err != nil {
+			c.issues = append(c.issues, &LintIssue{File: "-l", Msg: err.Error()})
+		}
+		for _, name := range unknown {
+			c.issues = append(c.issues, &LintIssue{File: name, Msg: "doesn't match any config key"})
+		}
+		for _, o := range overrides {
+			lines = append(lines, iniLine{section: o.section, key: o.key, value: o.value, source: o.source})
+		}
+		if err = applyOverrides(cfg, overrides); err != nil {
+			c.report(0, "%v", err)
+		}
+	}
+	known, listeners := c.checkKeys(lines)
+	c.checkValues(known, listeners)
+	if cfg != nil {
+		if conf, err = initAppConfig(); err != nil {
+			c.report(0, "%v", err)
+		}
+	}
+
+	ruleIssues, err := lintRules("rules.xml")
+	if err != nil {
+		c.issues = append(c.issues, &LintIssue{File: "rules.xml", Msg: err.Error()})
+	}
+	c.issues = append(c.issues, ruleIssues...)
+	if conf != nil {
+		// the rules files of the site profiles, loaded by initAppConfig
+		var linted = map[string]bool{"rules.xml": true}
+		for _, s := range conf.servers {
+			if s.Rules == NULL || linted[s.Rules] {
+				continue
+			}
+			linted[s.Rules] = true
+			profileIssues, err := lintRules(s.Rules)
+			if err == nil {
+				c.issues = append(c.issues, profileIssues...)
+			}
+		}
+	}
+	if conf != nil && err == nil {
+		// the load of the start, the rule groups of the config apply
+		saved := config
+		config = conf
+		if _, err = initReRules(); err != nil {
+			c.issues = append(c.issues, &LintIssue{File: "rules.xml", Msg: err.Error()})
+		}
+		config = saved
+	}
+	return c.issues, cfg, conf
+}
+
+func runCheck() int {
+	issues, cfg, conf := checkConfig()
+	if conf != nil {
+		printConfig(os.Stdout, cfg, conf)
+	}
+	var errs int
+	for _, i := range issues {
+		fmt.Println(i)
+		if !i.Warning {
+			errs++
+		}
+	}
+	if errs > 0 {
+		fmt.Printf("%d problem(s) found, %d warning(s)\n", errs, len(issues)-errs)
+		return 1
+	}
+	if len(issues) > 0 {
+		fmt.Printf("config ok, %d warning(s)\n", len(issues))
+		return 0
+	}
+	fmt.Println("config ok")
+	return 0
+}
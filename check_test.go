@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const checkSample = `[Basic]
+Host = www
+TrustProxy = true
+
+[HTTP.Server]
+Listen = :8080
+
+[HTTPS.Server]
+Listen = 127.0.0.1:8080
+TlsCertificate = missing.crt
+TlsCertificateKey = key.pem
+
+[ClientRestriction]
+Addresses = 10.0.0.0/8, 10.1.0/33
+
+[HeaderPolicy.x]
+Host = *.gstatic.com
+RequestSet.X-Test = 1
+RequestSett = 1
+
+[Bogus]
+Key = ` + "`a\nb`" + `
+
+[RuleGroups]
+promo = true
+`
+
+const checkRules = `<?xml version="1.0" encoding="utf-8"?>
+<ReRules>
+  <Html>
+    <ReRule bogus="1">
+      <ContentPattern flags="g">//www\.google\.com</ContentPattern>
+      <Replacement>/</Replacement>
+    </ReRule>
+  </Html>
+</ReRules>
+`
+
+func writeCheckDir(t *testing.T, files map[string]string) (dir string) {
+	dir, err := ioutil.TempDir(NULL, "ezgoo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir := writeCheckDir(t, map[string]string{
+		"config.ini": checkSample,
+		"rules.xml":  checkRules,
+		"key.pem":    "not a key",
+	})
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	issues, _, conf := checkConfig()
+	if conf != nil {
+		t.Errorf("config with a missing certificate loaded")
+	}
+	var got []string
+	for _, i := range issues {
+		got = append(got, i.String())
+	}
+	expected := []string{
+		"config.ini:2: unknown key Host in [Basic]",
+		"config.ini:19: unknown key RequestSett in [HeaderPolicy.x]",
+		"config.ini:21: unknown section [Bogus]",
+		`config.ini:14: ClientRestriction.Addresses: invalid CIDR "10.1.0/33"`,
+		"config.ini:10: HTTPS.Server.TlsCertificate: open missing.crt",
+		"config.ini:11: HTTPS.Server.TlsCertificateKey: no PEM data in key.pem",
+		"config.ini:9: HTTPS.Server.Listen: 127.0.0.1:8080 conflicts with HTTP.Server.Listen :8080",
+		"config.ini: HTTPS.Server: open missing.crt",
+		"rules.xml:4: warning: unknown attribute bogus",
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("issues:\n%s", strings.Join(got, "\n"))
+	}
+	for i, e := range expected {
+		if !strings.HasPrefix(got[i], e) {
+			t.Errorf("issue %d: %s, expected %s", i, got[i], e)
+		}
+	}
+}
+
+func TestCheckConfigRuleLoad(t *testing.T) {
+	// the rules load like at the start though the lint has warnings
+	rules := strings.Replace(checkRules, `<ReRule bogus="1">`, `<ReRule bogus="1" name="www" group="promo">`, 1)
+	rules = strings.Replace(rules, "</Html>", `<ReRule dependsOn="www">
+      <ContentPattern>x</ContentPattern>
+      <Replacement>y</Replacement>
+    </ReRule>
+  </Html>`, 1)
+	dir := writeCheckDir(t, map[string]string{
+		"config.ini": "[HTTP.Server]\nListen = :8080\n\n[RuleGroups]\npromo = false\n",
+		"rules.xml":  rules,
+	})
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	issues, _, conf := checkConfig()
+	if conf == nil || len(issues) != 2 || !issues[0].Warning || issues[1].Warning ||
+		!strings.Contains(issues[1].Msg, "www") {
+		t.Fatalf("issues=%v", issues)
+	}
+}
+
+func TestCheckConfigOk(t *testing.T) {
+	dir := writeCheckDir(t, map[string]string{
+		"config.ini": "[HTTP.Server]\nListen = :8080\n\n[CookieCrypto]\nKeys = c2VjcmV0c2VjcmV0c2VjcmV0\n\n[RuleGroups]\npromo = false\n",
+		"rules.xml":  strings.Replace(checkRules, ` bogus="1"`, NULL, 1),
+	})
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	issues, cfg, conf := checkConfig()
+	if len(issues) > 0 || conf == nil {
+		t.Fatalf("issues=%v", issues)
+	}
+	var buf = new(bytes.Buffer)
+	printConfig(buf, cfg, conf)
+	out := buf.String()
+	for _, s := range []string{
+		"[HTTP.Server]\nListen = :8080\n",
+		"[Redirect]\nFollow = false\nScope = same-host\n",
+		"BlockTime = 30m0s\n",
+		"[RuleGroups]\npromo = false\n",
+		"Keys = <hidden>\n",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("%q not printed in\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, "c2VjcmV0") {
+		t.Errorf("secret printed")
+	}
+}
@@ -2,18 +2,17 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 	"sync/atomic"
 
 	log "github.com/Lafeng/ezgoo/glog"
 	"github.com/Lafeng/ezgoo/regexp"
 	"github.com/armon/go-radix"
-	"github.com/go-ini/ini"
 	"github.com/spance/ipatrie"
 )
 
@@ -24,6 +23,11 @@ type RegexpDescr struct {
 
 type ReRule struct {
 	XMLName         xml.Name `xml:"ReRule"`
+	Name            string   `xml:"name,attr"`
+	Group           string   `xml:"group,attr"`
+	Priority        int      `xml:"priority,attr"`
+	Final           bool     `xml:"final,attr"`
+	DependsOn       string   `xml:"dependsOn,attr"`
 	PathPattern     *RegexpDescr
 	ContentPattern  *RegexpDescr
 	Replacement     []byte
@@ -33,6 +37,7 @@ type ReRule struct {
 	Scheme          uint32
 	PathRe          *RegexpHelper
 	ContentRe       *RegexpHelper
+	replFn          func(dst, src []byte, match []int) []byte
 }
 
 type RegexpHelper struct {
@@ -70,13 +75,26 @@ func (rd *RegexpDescr) initRegexpHelper() (*RegexpHelper, error) {
 	return r, nil
 }
 
-func (r *RegexpHelper) Replace(src, repl []byte) []byte {
+// return.arg2: the count of replaced matches
+func (r *RegexpHelper) Replace(src, repl []byte) ([]byte, int) {
 	if r.flag_g {
 		dst, n := r.ReplaceAll2(src, repl)
 		atomic.AddUint32(&r.counter, uint32(n))
-		return dst
+		return dst, n
 	} else {
-		return r.ReplaceOnce(src, repl)
+		return r.ReplaceOnce2(src, repl)
+	}
+}
+
+// ReplaceFunc is like Replace but the replacement is produced by repl,
+// used by the Replacement containing function references.
+func (r *RegexpHelper) ReplaceFunc(src []byte, repl func(dst, src []byte, match []int) []byte) ([]byte, int) {
+	if r.flag_g {
+		dst, n := r.ReplaceAllSubmatchFunc(src, repl)
+		atomic.AddUint32(&r.counter, uint32(n))
+		return dst, n
+	} else {
+		return r.ReplaceOnceSubmatchFunc(src, repl)
 	}
 }
 
@@ -92,8 +110,9 @@ func (r *ReRules) String() string {
 		case 2:
 			field = "json"
 		}
-		fmt.Fprintf(buf, field+"\n")
+		fmt.Fprintln(buf, field)
 		for i, v := range *rr {
+			fmt.Fprintf(buf, "%d           Name: %s group=%s priority=%d final=%v\n", i, v.Name, v.Group, v.Priority, v.Final)
 			fmt.Fprintf(buf, "%d    PathPattern: %v\n", i, v.PathPattern)
 			fmt.Fprintf(buf, "%d ContentPattern: %v\n", i, v.ContentPattern)
 			fmt.Fprintf(buf, "%d    Replacement: %v\n", i, v.Replacement)
@@ -105,18 +124,81 @@ func (r *ReRules) String() string {
 }
 
 func initReRules() (*ReRules, error) {
-	fd, err := ioutil.ReadFile("rules.xml")
+	var groups map[string]bool
+	if config != nil {
+		groups = config.ruleGroups
+	}
+	return loadReRules("rules.xml", groups)
+}
+
+// loadReRules reads a rules file, the rules of the disabled groups are
+// removed.
+func loadReRules(file string, groups map[string]bool) (*ReRules, error) {
+	fd, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
 	var rules ReRules
 	err = xml.Unmarshal(fd, &rules)
+	if err == nil {
+		err = arrangeRules(&rules, groups)
+	}
 	if err == nil {
 		err = initRegexp(&rules)
 	}
 	return &rules, err
 }
 
+// arrangeRules removes the rules of disabled groups, sorts every section
+// by priority (higher first, file order kept for equal priority) and
+// verifies that each rule comes after the rules it depends on.
+func arrangeRules(r *ReRules, groups map[string]bool) error {
+	for j, rr := range []*[]ReRule{&r.Html, &r.Js, &r.Json, &r.Css} {
+		section := [...]string{"html", "js", "json", "css"}[j]
+		var rules = make([]ReRule, 0, len(*rr))
+		var disabled = make(map[string]bool)
+		for _, ru := range *rr {
+			if enabled, y := groups[ru.Group]; y && !enabled {
+				disabled[ru.Name] = true
+				continue
+			}
+			rules = append(rules, ru)
+		}
+		sort.SliceStable(rules, func(a, b int) bool {
+			return rules[a].Priority > rules[b].Priority
+		})
+
+		var names = make(map[string]bool)
+		for _, ru := range rules {
+			names[ru.Name] = true
+		}
+		var seen = make(map[string]bool)
+		for i, ru := range rules {
+			for _, dep := range strings.Split(ru.DependsOn, ",") {
+				dep = strings.TrimSpace(dep)
+				if dep == NULL || seen[dep] {
+					continue
+				}
+				var reason = "must be ordered after"
+				if disabled[dep] {
+					reason = "depends on disabled"
+				} else if !names[dep] {
+					reason = "depends on unknown"
+				}
+				return fmt.Errorf("%s rule %d [%s] %s rule [%s]", section, i, ru.Name, reason, dep)
+			}
+			if ru.Name != NULL {
+				if seen[ru.Name] {
+					return fmt.Errorf("%s rule %d duplicate name [%s]", section, i, ru.Name)
+				}
+				seen[ru.Name] = true
+			}
+		}
+		*rr = rules
+	}
+	return nil
+}
+
 func initRegexp(r *ReRules) (err error) {
 	//dynRu := regexp.MustCompile(`\{(\w+)\}`)
 	for _, rr := range [][]ReRule{r.Html, r.Js, r.Json, r.Css} {
@@ -134,12 +216,25 @@ func initRegexp(r *ReRules) (err error) {
 					return
 				}
 			}
+			if ru.ContentRe != nil {
+				var tpl *ReplTemplate
+				tpl, err = compileReplacement(ru.ContentRe.Regexp, ru.Replacement)
+				if err != nil {
+					return
+				}
+				if tpl != nil {
+					ru.replFn = tpl.Expand(ru.ContentRe.Regexp)
+				}
+			}
 
 			if ru.SchemeExpr == NULL {
 				ru.SchemeExpr = "replace=all"
 			}
 
-			ru.Scheme = parseScheme(ru.SchemeExpr)
+			ru.Scheme, err = parseScheme(ru.SchemeExpr)
+			if err != nil {
+				return
+			}
 
 			if ru.InsertHeader != NULL {
 				ru.InsertHeader = strings.TrimSpace(ru.InsertHeader)
@@ -152,47 +247,66 @@ func initRegexp(r *ReRules) (err error) {
 // 0xFF ff FF ff
 //            ++ replace
 //         ++    insert
-func parseScheme(expr string) uint32 {
+func parseScheme(expr string) (uint32, error) {
 	var flags = []uint32{0, 0, 0, 0}
 	re1 := regexp.MustCompile("\\s+")
 	lines := re1.Split(strings.TrimSpace(expr), -1)
 	for _, line := range lines {
+		if line == NULL {
+			continue
+		}
 		tokens := strings.Split(line, "=")
-		if len(tokens) == 2 {
-			var bits *uint32
-			var token = strings.TrimSpace(tokens[0])
-			switch token {
-			case "replace":
-				bits = &flags[0]
-			case "insert":
-				bits = &flags[1]
-			default:
-				panic("unknown " + token)
-			}
-			token = strings.TrimSpace(tokens[1])
-			switch token {
-			case "all":
-				*bits = 0xff
-			case "modern":
-				*bits = 0xf
-			case "outdate":
-				*bits = 0x1
-			default:
-				panic("unknown " + token)
-			}
+		if len(tokens) != 2 {
+			return 0, fmt.Errorf("malformed scheme %q", line)
+		}
+		var bits *uint32
+		var token = strings.TrimSpace(tokens[0])
+		switch token {
+		case "replace":
+			bits = &flags[0]
+		case "insert":
+			bits = &flags[1]
+		default:
+			return 0, fmt.Errorf("unknown scheme %q", token)
+		}
+		token = strings.TrimSpace(tokens[1])
+		switch token {
+		case "all":
+			*bits = 0xff
+		case "modern":
+			*bits = 0xf
+		case "outdate":
+			*bits = 0x1
+		default:
+			return 0, fmt.Errorf("unknown scheme value %q", token)
 		}
 	}
-	return flags[0] | flags[1]<<8 | flags[2]<<16 | flags[3]<<24
+	return flags[0] | flags[1]<<8 | flags[2]<<16 | flags[3]<<24, nil
 }
 
 type AppConfig struct {
 	ForceHttps         bool
 	TrustProxy         bool
 	servers            []*AppServ
+	ruleGroups         map[string]bool
+	cookieJar          CookieJarConfig
+	cookieCrypto       CookieCryptoConfig
+	headerPolicies     HeaderPolicies
+	securityHeaders    SecurityHeaders
+	privacy            PrivacyConfig
+	paramRewrite       ParamRewriteConfig
+	redirect           RedirectConfig
+	metrics            MetricsConfig
+	prefDom            PrefDomConfig
+	abuse              AbuseConfig
+	egress             EgressConfig
+	redirector         RedirectorConfig
+	acme               ACMEConfig
+	tls                TLSConfig
+	routes             Routes
 	domainRestrictions DomainRestriction
 	clientRestrictions ClientRestriction
 	destChecker        *radix.Tree
-	ipaTrie            *ipatrie.Trie
 }
 
 type DomainRestriction struct {
@@ -205,14 +319,32 @@ type ClientRestriction struct {
 	UserAgent      string
 	Addresses      []string
 	prefixCount    int
+	ipaTrie        *ipatrie.Trie
 }
 
+// AppServ is a listener, the keys absent from its section are taken
+// from [Basic] and [ClientRestriction].
 type AppServ struct {
+	Name              string `ini:"-"`
+	section           string
 	tlType            TLType
-	cert              *tls.Certificate
+	certs             *CertStore
 	Listen            string
 	TlsCertificate    string
 	TlsCertificateKey string
+	// more certificates selected by SNI, comma-list of "cert key" or "file"
+	TlsCertificates []string
+	// serves the certificate of [ACME]
+	ACME              bool
+	ForceHttps        bool
+	TrustProxy        bool
+	clientRestriction ClientRestriction
+	// the site profile, the rules file and the [Routes.<name>] of the
+	// listener, empty means rules.xml and [Routes]
+	Rules  string
+	Routes string
+	rules  *ReRules
+	routes Routes
 }
 
 type TLType int
@@ -223,7 +355,7 @@ const (
 )
 
 func initAppConfig() (*AppConfig, error) {
-	cfg, err := ini.Load("config.ini")
+	cfg, err := loadConfigFile()
 	if err != nil {
 		return nil, err
 	}
@@ -240,23 +372,123 @@ func initAppConfig() (*AppConfig, error) {
 	if err != nil {
 		return nil, err
 	}
-	var servs = make([]*AppServ, 2)
-	for i, label := range []string{"0HTTP.Server", "1HTTPS.Server"} {
-		var serv = new(AppServ)
-		servs[i] = serv
-		serv.tlType = TLType(int(label[0]) - 0x30)
-		err = cfg.Section(label[1:]).MapTo(serv)
+	err = cfg.Section("CookieJar").MapTo(&conf.cookieJar)
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.Section("CookieCrypto").MapTo(&conf.cookieCrypto)
+	if err != nil {
+		return nil, err
+	}
+	conf.securityHeaders = defaultSecurityHeaders()
+	err = cfg.Section("SecurityHeaders").MapTo(&conf.securityHeaders)
+	if err == nil {
+		err = conf.securityHeaders.verify()
+	}
+	if err != nil {
+		return nil, err
+	}
+	conf.privacy = defaultPrivacyConfig()
+	err = cfg.Section("Privacy").MapTo(&conf.privacy)
+	if err != nil {
+		return nil, err
+	}
+	conf.privacy.init()
+	conf.paramRewrite = defaultParamRewriteConfig()
+	err = cfg.Section("ParamRewrite").MapTo(&conf.paramRewrite)
+	if err != nil {
+		return nil, err
+	}
+	conf.paramRewrite.init()
+	conf.redirect = defaultRedirectConfig()
+	err = cfg.Section("Redirect").MapTo(&conf.redirect)
+	if err == nil {
+		err = conf.redirect.verify()
+	}
+	if err != nil {
+		return nil, err
+	}
+	conf.metrics = defaultMetricsConfig()
+	err = cfg.Section("Metrics").MapTo(&conf.metrics)
+	if err == nil {
+		err = conf.metrics.init()
+	}
+	if err != nil {
+		return nil, err
+	}
+	conf.prefDom = defaultPrefDomConfig()
+	err = cfg.Section("PrefDom").MapTo(&conf.prefDom)
+	if err != nil {
+		return nil, err
+	}
+	conf.abuse = defaultAbuseConfig()
+	err = cfg.Section("Abuse").MapTo(&conf.abuse)
+	if err != nil {
+		return nil, err
+	}
+	conf.egress = defaultEgressConfig()
+	err = cfg.Section("Egress").MapTo(&conf.egress)
+	if err == nil {
+		err = conf.egress.init()
+	}
+	if err != nil {
+		return nil, err
+	}
+	conf.redirector = defaultRedirectorConfig()
+	err = cfg.Section("Redirector").MapTo(&conf.redirector)
+	if err == nil {
+		err = conf.redirector.init()
+	}
+	if err != nil {
+		return nil, err
+	}
+	conf.acme = defaultACMEConfig()
+	err = cfg.Section("ACME").MapTo(&conf.acme)
+	if err == nil {
+		err = conf.acme.init()
+	}
+	if err != nil {
+		return nil, err
+	}
+	conf.tls = defaultTLSConfig()
+	err = cfg.Section("TLS").MapTo(&conf.tls)
+	if err == nil {
+		err = conf.tls.init()
+	}
+	if err != nil {
+		return nil, err
+	}
+	conf.headerPolicies, err = initHeaderPolicies(cfg)
+	if err != nil {
+		return nil, err
+	}
+	conf.ruleGroups = make(map[string]bool)
+	for _, key := range cfg.Section("RuleGroups").Keys() {
+		enabled, err := key.Bool()
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("RuleGroups.%s: %v", key.Name(), err)
 		}
+		conf.ruleGroups[key.Name()] = enabled
 	}
-	err = conf.verifyServerConfig(servs)
+	err = conf.initListeners(cfg)
 	if err != nil {
 		return nil, err
 	}
+	for _, s := range conf.servers {
+		if s.ACME && !conf.acme.Enabled {
+			return nil, fmt.Errorf("%s: ACME is not enabled", s.section)
+		}
+	}
 	// init restrictions
 	conf.initDomainRestriction()
-	conf.initClientRestriction()
+	conf.clientRestrictions.init()
+	conf.routes, err = initRoutes(cfg, "Routes", conf)
+	if err != nil {
+		return nil, err
+	}
+	if err = conf.initProfiles(cfg); err != nil {
+		return nil, err
+	}
 	conf.PrintInfo()
 	return conf, err
 }
@@ -294,25 +526,30 @@ func (c *AppConfig) CheckDomainRestriction(host string) bool {
 	return true
 }
 
-func (c *AppConfig) initClientRestriction() {
-	prefix := c.clientRestrictions.Addresses
+func (r *ClientRestriction) init() {
+	prefix := r.Addresses
 	if len(prefix) <= 0 {
 		return
 	}
-	c.ipaTrie = ipatrie.NewTrie()
+	r.ipaTrie = ipatrie.NewTrie()
 	for _, p := range prefix {
 		a, m, e := ipatrie.ParseCIDR(p)
 		if e == nil {
-			c.ipaTrie.Insert(a, m)
+			r.ipaTrie.Insert(a, m)
 		} else {
 			log.Warningf("Parse cidr=%s error=%v", p, e)
 		}
 	}
-	c.clientRestrictions.prefixCount = c.ipaTrie.Size()
+	r.prefixCount = r.ipaTrie.Size()
 }
 
+// CheckClientRestriction checks r by the restriction of the listener of s,
+// [ClientRestriction] if it has none.
 func (c *AppConfig) CheckClientRestriction(s *Session, r *http.Request) bool {
-	res := c.clientRestrictions
+	res := &c.clientRestrictions
+	if s.serv != nil {
+		res = &s.serv.clientRestriction
+	}
 	if len(res.AcceptLanguage) > 0 && !strings.Contains(r.Header.Get("Accept-Language"), res.AcceptLanguage) {
 		return false
 	}
@@ -321,47 +558,23 @@ func (c *AppConfig) CheckClientRestriction(s *Session, r *http.Request) bool {
 		return false
 	}
 
-	if c.ipaTrie != nil {
+	if res.ipaTrie != nil {
 		remoteAddr := ipatrie.ParseIPv4(s.aAddr)
 		// ipv6 passed
-		if remoteAddr > 0 && !c.ipaTrie.Match(remoteAddr) {
+		if remoteAddr > 0 && !res.ipaTrie.Match(remoteAddr) {
 			return false
 		}
 	}
 	return true
 }
 
-func (c *AppConfig) verifyServerConfig(_servs []*AppServ) error {
-	var servs = make([]*AppServ, 0, 2)
-	for _, s := range _servs {
-		switch s.tlType {
-		case TL_PLAIN: // http
-			if len(s.Listen) > 0 {
-				servs = append(servs, s)
-			}
-		case TL_TLS: // https
-			if len(s.Listen) > 0 {
-				servs = append(servs, s)
-			} else {
-				continue
-			}
-			cert, err := tls.LoadX509KeyPair(s.TlsCertificate, s.TlsCertificateKey)
-			if err == nil {
-				s.cert = &cert
-			} else {
-				return err
-			}
-		}
-	}
-	if len(servs) < 1 {
-		return fmt.Errorf("both http.server and https.server were not specified")
-	}
-	c.servers = servs
-	return nil
-}
-
 func (c *AppConfig) PrintInfo() {
 	d, r := c.domainRestrictions, c.clientRestrictions
 	log.Infof("DomainRestriction count=%d\n", d.count)
 	log.Infof("ClientRestriction AL=[%s] UA=[%s] CIDR=%d\n", r.AcceptLanguage, r.UserAgent, r.prefixCount)
+	for _, s := range c.servers {
+		r = s.clientRestriction
+		log.Infof("Listener %s listen=%s tls=%v ClientRestriction AL=[%s] UA=[%s] CIDR=%d\n",
+			s.Name, s.Listen, s.tlType == TL_TLS, r.AcceptLanguage, r.UserAgent, r.prefixCount)
+	}
 }
@@ -5,6 +5,8 @@ import (
 	"os"
 	"reflect"
 	"testing"
+
+	log "github.com/Lafeng/ezgoo/glog"
 )
 
 func init() {
@@ -29,3 +31,69 @@ func TestConfig(t *testing.T) {
 	t.Log(conf.domainRestrictions)
 	t.Log(conf.clientRestrictions)
 }
+
+func TestArrangeRules(t *testing.T) {
+	var rules = &ReRules{
+		Html: []ReRule{
+			{Name: "a"},
+			{Name: "b", Priority: 1},
+			{Name: "c", DependsOn: "a, b"},
+			{Name: "d", Group: "off"},
+		},
+	}
+	err := arrangeRules(rules, map[string]bool{"off": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names string
+	for _, r := range rules.Html {
+		names += r.Name
+	}
+	if names != "bac" {
+		t.Errorf("order=%s", names)
+	}
+
+	for _, deps := range []string{"d", "x", "c"} {
+		rules = &ReRules{
+			Css: []ReRule{
+				{Name: "c", DependsOn: deps},
+				{Name: "d", Group: "off"},
+			},
+		}
+		if err = arrangeRules(rules, map[string]bool{"off": false}); err == nil {
+			t.Errorf("dependsOn=%s expected error", deps)
+		} else {
+			t.Log(err)
+		}
+	}
+}
+
+func TestFinalRules(t *testing.T) {
+	var rules = &ReRules{
+		Html: []ReRule{
+			{Name: "ins", Final: true, ContentPattern: &RegexpDescr{Pattern: "<head>"}, SchemeExpr: "insert=all", InsertHeader: "<x>"},
+			{Name: "rep", ContentPattern: &RegexpDescr{Pattern: "a", Flags: "g"}, Replacement: []byte("b")},
+		},
+	}
+	if err := initRegexp(rules); err != nil {
+		t.Fatal(err)
+	}
+	// the insert-only final rule stops the section once its pattern is found
+	body, header := applyRules(rules.Html, "/", []byte("<head>aa"))
+	if string(body) != "<head>aa" || header != "<x>" {
+		t.Errorf("matched: body=%s header=%s", body, header)
+	}
+	body, header = applyRules(rules.Html, "/", []byte("aa"))
+	if string(body) != "bb" || header != "<x>" {
+		t.Errorf("unmatched: body=%s header=%s", body, header)
+	}
+
+	// a final rule without pattern always stops, logged by its name
+	rules.Html[0].ContentPattern, rules.Html[0].ContentRe = nil, nil
+	log.SetLogVerbose(4)
+	defer log.SetLogVerbose(0)
+	body, header = applyRules(rules.Html, "/", []byte("aa"))
+	if string(body) != "aa" || header != "<x>" {
+		t.Errorf("no pattern: body=%s header=%s", body, header)
+	}
+}
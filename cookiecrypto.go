@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+type CookieCryptoConfig struct {
+	Enabled bool
+	// comma-list of base64 AES keys (16, 24 or 32 bytes),
+	// the first one encrypts and all of them decrypt
+	Keys []string
+}
+
+const (
+	cookieSealPrefix = "ez1."
+	cookieKeyIdSize  = 4
+)
+
+// CookieCipher encrypts and authenticates the upstream cookie values
+// passed to the browser.
+type CookieCipher struct {
+	aeads []cipher.AEAD
+	ids   [][]byte
+}
+
+var cookieCipher *CookieCipher
+
+func NewCookieCipher(keys []string) (*CookieCipher, error) {
+	var c = new(CookieCipher)
+	for i, k := range keys {
+		k = strings.TrimSpace(k)
+		if k == NULL {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("cookie key %d: %v", i, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("cookie key %d: %v", i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		// key id lets the keys be reordered freely on rotation
+		sum := sha256.Sum256(key)
+		c.aeads = append(c.aeads, aead)
+		c.ids = append(c.ids, sum[:cookieKeyIdSize])
+	}
+	if len(c.aeads) == 0 {
+		return nil, fmt.Errorf("no cookie key")
+	}
+	return c, nil
+}
+
+// cookieScope returns the proxy path prefix of the cookies of the upstream
+// host, "/" for those of the default host.
+func cookieScope(host string) string {
+	if host == NULL {
+		return "/"
+	}
+	return "/!" + host
+}
+
+// cookieAAD binds a sealed value to the cookie name and to the scope of
+// the upstream host, so it can't be swapped between cookies or hosts.
+func cookieAAD(name, scope string) []byte {
+	return []byte(name + "\x00" + scope)
+}
+
+// Seal encrypts the value of the cookie named name of scope with the first
+// key, see cookieAAD.
+func (c *CookieCipher) Seal(name, scope, value string) string {
+	aead := c.aeads[0]
+	var buf = make([]byte, cookieKeyIdSize+aead.NonceSize(), cookieKeyIdSize+aead.NonceSize()+len(value)+aead.Overhead())
+	copy(buf, c.ids[0])
+	nonce := buf[cookieKeyIdSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	buf = aead.Seal(buf, nonce, []byte(value), cookieAAD(name, scope))
+	return cookieSealPrefix + base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// Open returns the plain value, false if value was not sealed by
+// any of the keys for name and scope or was tampered with.
+func (c *CookieCipher) Open(name, scope, value string) (string, bool) {
+	if !strings.HasPrefix(value, cookieSealPrefix) {
+		return NULL, false
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(value[len(cookieSealPrefix):])
+	if err != nil || len(buf) < cookieKeyIdSize {
+		return NULL, false
+	}
+	for i, id := range c.ids {
+		if !bytes.Equal(id, buf[:cookieKeyIdSize]) {
+			continue
+		}
+		aead := c.aeads[i]
+		sealed := buf[cookieKeyIdSize:]
+		if len(sealed) < aead.NonceSize() {
+			return NULL, false
+		}
+		plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], cookieAAD(name, scope))
+		if err != nil {
+			return NULL, false
+		}
+		return string(plain), true
+	}
+	return NULL, false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	testCookieKey1 = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	testCookieKey2 = "ZmVkY2JhOTg3NjU0MzIxMA=="
+)
+
+func TestCookieCipher(t *testing.T) {
+	old, err := NewCookieCipher([]string{testCookieKey1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := old.Seal("NID", "/", "67=abc")
+	if strings.Contains(sealed, "abc") {
+		t.Errorf("sealed=%s", sealed)
+	}
+	if v, ok := old.Open("NID", "/", sealed); !ok || v != "67=abc" {
+		t.Errorf("open=%s %v", v, ok)
+	}
+	if _, ok := old.Open("SID", "/", sealed); ok {
+		t.Errorf("opened with another name")
+	}
+	// the value of another host or of the default host doesn't open
+	scoped := old.Seal("NID", cookieScope("scholar.google.com"), "1")
+	for _, scope := range []string{"/", cookieScope("maps.google.com")} {
+		if _, ok := old.Open("NID", scope, scoped); ok {
+			t.Errorf("opened in scope %s", scope)
+		}
+	}
+	if v, ok := old.Open("NID", cookieScope("scholar.google.com"), scoped); !ok || v != "1" {
+		t.Errorf("scoped open=%s %v", v, ok)
+	}
+	tampered := []byte(sealed)
+	tampered[len(tampered)-3] ^= 1
+	if _, ok := old.Open("NID", "/", string(tampered)); ok {
+		t.Errorf("opened tampered value")
+	}
+	if _, ok := old.Open("NID", "/", "67=abc"); ok {
+		t.Errorf("opened plain value")
+	}
+
+	// rotation: the new key encrypts, the old one still decrypts
+	rotated, err := NewCookieCipher([]string{testCookieKey2, testCookieKey1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := rotated.Open("NID", "/", sealed); !ok || v != "67=abc" {
+		t.Errorf("rotated open=%s %v", v, ok)
+	}
+	if _, ok := old.Open("NID", "/", rotated.Seal("NID", "/", "x")); ok {
+		t.Errorf("old cipher opened the value of the new key")
+	}
+
+	for _, keys := range [][]string{nil, {"bm9wZQ=="}, {"!"}} {
+		if _, err = NewCookieCipher(keys); err == nil {
+			t.Errorf("keys=%v expected error", keys)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Lafeng/ezgoo/glog"
+)
+
+type CookieJarConfig struct {
+	Enabled bool
+	// name of the only cookie held by the browser
+	CookieName string
+	// sessions idle longer than Expiry are dropped
+	Expiry time.Duration
+	// empty means memory only
+	PersistFile  string
+	SaveInterval time.Duration
+	// the least recently used sessions are dropped beyond MaxSessions,
+	// the oldest cookies of a session beyond MaxCookies
+	MaxSessions int
+	MaxCookies  int
+}
+
+// jarCookie is an upstream cookie stored as described in RFC 6265 5.3
+type jarCookie struct {
+	Name       string
+	Value      string
+	Domain     string
+	Path       string
+	HostOnly   bool
+	Persistent bool
+	Expires    time.Time
+	Creation   time.Time
+}
+
+func (c *jarCookie) key() string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+func (c *jarCookie) expired(now time.Time) bool {
+	return c.Persistent && !c.Expires.After(now)
+}
+
+// CookieSession holds the upstream cookies of one browser
+type CookieSession struct {
+	mu         sync.Mutex
+	Entries    map[string]*jarCookie
+	LastAccess time.Time
+	refreshed  time.Time // when the browser cookie was sent last
+}
+
+type CookieJar struct {
+	conf     *CookieJarConfig
+	mu       sync.Mutex
+	sessions map[string]*CookieSession
+	stop     chan bool
+}
+
+var cookieJar *CookieJar
+
+func NewCookieJar(conf *CookieJarConfig) (*CookieJar, error) {
+	if conf.CookieName == NULL {
+		conf.CookieName = "ezgoo_sid"
+	}
+	if conf.Expiry <= 0 {
+		conf.Expiry = 30 * 24 * time.Hour
+	}
+	if conf.SaveInterval <= 0 {
+		conf.SaveInterval = 5 * time.Minute
+	}
+	if conf.MaxSessions <= 0 {
+		conf.MaxSessions = 100000
+	}
+	if conf.MaxCookies <= 0 {
+		conf.MaxCookies = 100
+	}
+	j := &CookieJar{
+		conf:     conf,
+		sessions: make(map[string]*CookieSession),
+		stop:     make(chan bool),
+	}
+	if conf.PersistFile != NULL {
+		data, err := ioutil.ReadFile(conf.PersistFile)
+		if err == nil {
+			err = json.Unmarshal(data, &j.sessions)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	// the file may have been edited by hand
+	if j.sessions == nil {
+		j.sessions = make(map[string]*CookieSession)
+	}
+	for sid, cs := range j.sessions {
+		if cs == nil {
+			delete(j.sessions, sid)
+		} else if cs.Entries == nil {
+			cs.Entries = make(map[string]*jarCookie)
+		}
+	}
+	j.expire(time.Now())
+	j.mu.Lock()
+	j.evict(len(j.sessions) - conf.MaxSessions)
+	j.mu.Unlock()
+	go j.maintain()
+	return j, nil
+}
+
+// Lookup returns the session named by the ezgoo cookie of the request,
+// or nil if there is none.
+func (j *CookieJar) Lookup(req *http.Request) (string, *CookieSession) {
+	ck, err := req.Cookie(j.conf.CookieName)
+	if err != nil {
+		return NULL, nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	cs := j.sessions[ck.Value]
+	if cs == nil {
+		return NULL, nil
+	}
+	cs.mu.Lock()
+	cs.LastAccess = time.Now()
+	cs.mu.Unlock()
+	return ck.Value, cs
+}
+
+func (j *CookieJar) NewSession() (string, *CookieSession) {
+	var b = make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	sid := hex.EncodeToString(b)
+	cs := &CookieSession{
+		Entries:    make(map[string]*jarCookie),
+		LastAccess: time.Now(),
+	}
+	j.mu.Lock()
+	if over := len(j.sessions) - j.conf.MaxSessions; over >= 0 {
+		// evict a few more to not sort the sessions for every new one
+		j.evict(over + 1 + j.conf.MaxSessions/100)
+	}
+	j.sessions[sid] = cs
+	j.mu.Unlock()
+	return sid, cs
+}
+
+// evict drops the n least recently used sessions, the caller holds mu.
+func (j *CookieJar) evict(n int) {
+	if n <= 0 {
+		return
+	}
+	type idle struct {
+		sid  string
+		last time.Time
+	}
+	var all = make([]idle, 0, len(j.sessions))
+	for sid, cs := range j.sessions {
+		cs.mu.Lock()
+		all = append(all, idle{sid, cs.LastAccess})
+		cs.mu.Unlock()
+	}
+	sort.Slice(all, func(a, b int) bool {
+		return all[a].last.Before(all[b].last)
+	})
+	if n > len(all) {
+		n = len(all)
+	}
+	for _, s := range all[:n] {
+		delete(j.sessions, s.sid)
+	}
+	if log.V(1) {
+		log.Infof("Evicted %d sessions from the cookie jar\n", n)
+	}
+}
+
+// SessionCookie returns the cookie carrying sid to the browser if it is
+// new or should be refreshed, otherwise nil.
+func (j *CookieJar) SessionCookie(sid string, cs *CookieSession, secure bool) *http.Cookie {
+	now := time.Now()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if now.Sub(cs.refreshed) < j.conf.Expiry/10 {
+		return nil
+	}
+	cs.refreshed = now
+	return &http.Cookie{
+		Name:     j.conf.CookieName,
+		Value:    sid,
+		Path:     "/",
+		MaxAge:   int(j.conf.Expiry / time.Second),
+		Secure:   secure,
+		HttpOnly: true,
+	}
+}
+
+func (j *CookieJar) expire(now time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for sid, cs := range j.sessions {
+		cs.mu.Lock()
+		if now.Sub(cs.LastAccess) > j.conf.Expiry {
+			delete(j.sessions, sid)
+		} else {
+			for k, c := range cs.Entries {
+				if c.expired(now) {
+					delete(cs.Entries, k)
+				}
+			}
+		}
+		cs.mu.Unlock()
+	}
+}
+
+func (j *CookieJar) Save() error {
+	if j.conf.PersistFile == NULL {
+		return nil
+	}
+	j.mu.Lock()
+	var sessions = make(map[string]*CookieSession, len(j.sessions))
+	for sid, cs := range j.sessions {
+		cs.mu.Lock()
+		copied := &CookieSession{
+			Entries:    make(map[string]*jarCookie, len(cs.Entries)),
+			LastAccess: cs.LastAccess,
+		}
+		for k, c := range cs.Entries {
+			dup := *c
+			copied.Entries[k] = &dup
+		}
+		cs.mu.Unlock()
+		sessions[sid] = copied
+	}
+	j.mu.Unlock()
+
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	tmp := j.conf.PersistFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.conf.PersistFile)
+}
+
+func (j *CookieJar) maintain() {
+	ticker := time.NewTicker(j.conf.SaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			j.expire(now)
+			if err := j.Save(); err != nil {
+				log.Warningln("Save cookie jar", err)
+			}
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+// Close saves the jar, used on exiting.
+func (j *CookieJar) Close() error {
+	close(j.stop)
+	return j.Save()
+}
+
+// newJarCookie converts a cookie received in the response of u,
+// it returns nil if the cookie is rejected.
+func newJarCookie(u *url.URL, ck *http.Cookie, now time.Time) *jarCookie {
+	host := canonicalHost(u.Host)
+	c := &jarCookie{
+		Name:     ck.Name,
+		Value:    ck.Value,
+		Path:     ck.Path,
+		Creation: now,
+	}
+	// 5.3.6 domain
+	domain := strings.TrimPrefix(strings.ToLower(ck.Domain), ".")
+	if domain == NULL || domain == host {
+		c.Domain, c.HostOnly = host, domain == NULL
+	} else if domainMatch(host, domain) && strings.IndexByte(domain, '.') > 0 && !publicSuffix(domain) {
+		c.Domain = domain
+	} else {
+		return nil
+	}
+	// 5.3.7 path
+	if c.Path == NULL || c.Path[0] != '/' {
+		c.Path = defaultPath(u.Path)
+	}
+	// 5.3.3 expires and max-age
+	switch {
+	case ck.MaxAge < 0:
+		c.Persistent, c.Expires = true, now
+	case ck.MaxAge > 0:
+		c.Persistent, c.Expires = true, now.Add(time.Duration(ck.MaxAge)*time.Second)
+	case !ck.Expires.IsZero():
+		c.Persistent, c.Expires = true, ck.Expires
+	}
+	return c
+}
+
+// keepsAny tells whether any of the cookies received from u would be stored
+func keepsAny(u *url.URL, cookies []*http.Cookie) bool {
+	now := time.Now()
+	for _, ck := range cookies {
+		if c := newJarCookie(u, ck, now); c != nil && !c.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetCookies stores the cookies received in the response of u,
+// the oldest ones are dropped beyond max if it is positive.
+func (cs *CookieSession) SetCookies(u *url.URL, cookies []*http.Cookie, max int) {
+	now := time.Now()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, ck := range cookies {
+		c := newJarCookie(u, ck, now)
+		if c == nil {
+			continue
+		}
+		k := c.key()
+		if c.expired(now) {
+			delete(cs.Entries, k)
+			continue
+		}
+		if old := cs.Entries[k]; old != nil {
+			c.Creation = old.Creation
+		}
+		cs.Entries[k] = c
+	}
+	for max > 0 && len(cs.Entries) > max {
+		var oldest string
+		for k, c := range cs.Entries {
+			if oldest == NULL || c.Creation.Before(cs.Entries[oldest].Creation) {
+				oldest = k
+			}
+		}
+		delete(cs.Entries, oldest)
+	}
+}
+
+// Cookies returns the cookies to send in a request to u, RFC 6265 5.4
+func (cs *CookieSession) Cookies(u *url.URL) []*http.Cookie {
+	host := canonicalHost(u.Host)
+	path := u.Path
+	if path == NULL {
+		path = "/"
+	}
+	now := time.Now()
+	cs.mu.Lock()
+	var selected []*jarCookie
+	for k, c := range cs.Entries {
+		if c.expired(now) {
+			delete(cs.Entries, k)
+			continue
+		}
+		if c.HostOnly && host != c.Domain || !c.HostOnly && !domainMatch(host, c.Domain) {
+			continue
+		}
+		if !pathMatch(path, c.Path) {
+			continue
+		}
+		selected = append(selected, c)
+	}
+	cs.mu.Unlock()
+
+	sort.Slice(selected, func(a, b int) bool {
+		if len(selected[a].Path) != len(selected[b].Path) {
+			return len(selected[a].Path) > len(selected[b].Path)
+		}
+		return selected[a].Creation.Before(selected[b].Creation)
+	})
+	var cookies = make([]*http.Cookie, len(selected))
+	for i, c := range selected {
+		cookies[i] = &http.Cookie{Name: c.Name, Value: c.Value}
+	}
+	return cookies
+}
+
+func canonicalHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// 5.1.3
+func domainMatch(host, domain string) bool {
+	if host == domain {
+		return true
+	}
+	return strings.HasSuffix(host, "."+domain) && net.ParseIP(host) == nil
+}
+
+// the second-level labels registered under the country code TLDs, e.g. co.uk
+var ccSecondLevels = map[string]bool{
+	"ac": true, "co": true, "com": true, "edu": true, "go": true, "gob": true,
+	"gov": true, "ne": true, "net": true, "or": true, "org": true,
+}
+
+// publicSuffix tells whether domain is a public suffix like co.uk or com.au.
+// there is no public suffix list, only the common second levels of the
+// country code TLDs are recognized, the single labels are rejected by the caller.
+func publicSuffix(domain string) bool {
+	i := strings.IndexByte(domain, '.')
+	return i > 0 && ccSecondLevels[domain[:i]] && len(domain)-i-1 == 2
+}
+
+// 5.1.4
+func defaultPath(path string) string {
+	if path == NULL || path[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndexByte(path, '/')
+	if i == 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+func pathMatch(reqPath, cookiePath string) bool {
+	if reqPath == cookiePath {
+		return true
+	}
+	if strings.HasPrefix(reqPath, cookiePath) {
+		return cookiePath[len(cookiePath)-1] == '/' || reqPath[len(cookiePath)] == '/'
+	}
+	return false
+}
+
+// storeCookies keeps the upstream cookies of u in the server-side jar,
+// the browser receives only the ezgoo session cookie.
+func (s *Session) storeCookies(u *url.URL, cookies []*http.Cookie, h http.Header) {
+	if s.jar == nil {
+		// no session for the browsers only receiving deletions or rejects
+		if !keepsAny(u, cookies) {
+			return
+		}
+		s.sid, s.jar = cookieJar.NewSession()
+	}
+	s.jar.SetCookies(u, cookies, cookieJar.conf.MaxCookies)
+	if ck := cookieJar.SessionCookie(s.sid, s.jar, s.aProto == "https"); ck != nil {
+		h.Add("Set-Cookie", ck.String())
+	}
+}
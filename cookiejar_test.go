@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func cookieNames(cookies []*http.Cookie) string {
+	var names []string
+	for _, ck := range cookies {
+		names = append(names, ck.Name+"="+ck.Value)
+	}
+	return strings.Join(names, "; ")
+}
+
+func TestCookieSession(t *testing.T) {
+	cs := &CookieSession{Entries: make(map[string]*jarCookie)}
+	u, _ := url.Parse("https://www.google.com/search/x?q=1")
+	cs.SetCookies(u, []*http.Cookie{
+		{Name: "NID", Value: "1", Domain: ".google.com", Path: "/"},
+		{Name: "host", Value: "2"},
+		{Name: "deep", Value: "3", Path: "/search/x"},
+		{Name: "evil", Value: "4", Domain: "example.com"},
+		{Name: "tld", Value: "5", Domain: "com"},
+		{Name: "old", Value: "6", Expires: time.Now().Add(-time.Hour)},
+		{Name: "gone", Value: "7", MaxAge: -1},
+	}, 0)
+
+	samples := []struct {
+		url, cookies string
+	}{
+		{"https://www.google.com/search/x", "deep=3; host=2; NID=1"},
+		{"https://www.google.com/search/xy", "host=2; NID=1"},
+		{"https://www.google.com/", "NID=1"},
+		{"https://ssl.google.com/search", "NID=1"},
+		{"https://google.com/", "NID=1"},
+		{"https://example.com/", ""},
+	}
+	for _, sa := range samples {
+		u, _ := url.Parse(sa.url)
+		if got := cookieNames(cs.Cookies(u)); got != sa.cookies {
+			t.Errorf("url=%s cookies=[%s] expected=[%s]", sa.url, got, sa.cookies)
+		}
+	}
+
+	// overwrite and delete
+	cs.SetCookies(u, []*http.Cookie{
+		{Name: "NID", Value: "9", Domain: "google.com", Path: "/"},
+		{Name: "host", Value: NULL, MaxAge: -1},
+	}, 0)
+	if got := cookieNames(cs.Cookies(u)); got != "deep=3; NID=9" {
+		t.Errorf("cookies=[%s]", got)
+	}
+
+	// public suffixes
+	uk, _ := url.Parse("https://www.google.co.uk/")
+	cs.SetCookies(uk, []*http.Cookie{
+		{Name: "psl", Value: "1", Domain: ".co.uk"},
+		{Name: "NID", Value: "2", Domain: ".google.co.uk"},
+	}, 0)
+	other, _ := url.Parse("https://www.example.co.uk/")
+	if got := cookieNames(cs.Cookies(uk)); got != "NID=2" {
+		t.Errorf("cookies=[%s]", got)
+	}
+	if got := cookieNames(cs.Cookies(other)); got != NULL {
+		t.Errorf("cookies of another site=[%s]", got)
+	}
+}
+
+func TestCookieJarPersist(t *testing.T) {
+	file := filepath.Join(os.TempDir(), "ezgoo_cookies.json")
+	os.Remove(file)
+	defer os.Remove(file)
+
+	conf := &CookieJarConfig{Enabled: true, PersistFile: file}
+	jar, err := NewCookieJar(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, cs := jar.NewSession()
+	u, _ := url.Parse("https://www.google.com/")
+	cs.SetCookies(u, []*http.Cookie{{Name: "NID", Value: "1", MaxAge: 3600}}, 0)
+	ck := jar.SessionCookie(sid, cs, true)
+	if ck == nil || ck.Name != "ezgoo_sid" || ck.Value != sid {
+		t.Fatalf("session cookie=%v", ck)
+	}
+	if jar.SessionCookie(sid, cs, true) != nil {
+		t.Errorf("session cookie sent twice")
+	}
+	if err = jar.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	jar, err = NewCookieJar(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jar.Close()
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	req.AddCookie(&http.Cookie{Name: "ezgoo_sid", Value: sid})
+	got, cs := jar.Lookup(req)
+	if got != sid || cs == nil {
+		t.Fatalf("lookup sid=%s", got)
+	}
+	if names := cookieNames(cs.Cookies(u)); names != "NID=1" {
+		t.Errorf("cookies=[%s]", names)
+	}
+}
+
+func TestCookieJarLoad(t *testing.T) {
+	file := filepath.Join(os.TempDir(), "ezgoo_cookies_null.json")
+	defer os.Remove(file)
+	recent, _ := time.Now().MarshalJSON()
+	data := `{"a":null,"b":{"Entries":null,"LastAccess":` + string(recent) + `}}`
+	for _, content := range []string{data, "null"} {
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		jar, err := NewCookieJar(&CookieJarConfig{Enabled: true, PersistFile: file})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := jar.sessions["a"]; ok {
+			t.Errorf("nil session kept")
+		}
+		u, _ := url.Parse("https://www.google.com/")
+		if cs := jar.sessions["b"]; cs != nil {
+			cs.SetCookies(u, []*http.Cookie{{Name: "NID", Value: "1"}}, 0)
+			if got := cookieNames(cs.Cookies(u)); got != "NID=1" {
+				t.Errorf("cookies=[%s]", got)
+			}
+		} else if content == data {
+			t.Errorf("session b dropped")
+		}
+		jar.NewSession()
+		jar.Close()
+	}
+}
+
+func TestCookieJarLimits(t *testing.T) {
+	jar, err := NewCookieJar(&CookieJarConfig{Enabled: true, MaxSessions: 3, MaxCookies: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jar.Close()
+	var sids []string
+	for i := 0; i < 3; i++ {
+		sid, cs := jar.NewSession()
+		cs.LastAccess = time.Now().Add(time.Duration(i-10) * time.Minute)
+		sids = append(sids, sid)
+	}
+	jar.NewSession()
+	if len(jar.sessions) != 3 || jar.sessions[sids[0]] != nil || jar.sessions[sids[1]] == nil {
+		t.Errorf("sessions=%d evicted the wrong one", len(jar.sessions))
+	}
+
+	cs := jar.sessions[sids[2]]
+	u, _ := url.Parse("https://www.google.com/")
+	cs.SetCookies(u, []*http.Cookie{{Name: "a", Value: "1"}}, 2)
+	cs.Entries["www.google.com;/;a"].Creation = time.Now().Add(-time.Hour)
+	cs.SetCookies(u, []*http.Cookie{{Name: "b", Value: "2"}, {Name: "c", Value: "3"}}, 2)
+	if got := cookieNames(cs.Cookies(u)); got != "b=2; c=3" && got != "c=3; b=2" {
+		t.Errorf("cookies=[%s]", got)
+	}
+}
+
+func TestStoreCookies(t *testing.T) {
+	var err error
+	cookieJar, err = NewCookieJar(&CookieJarConfig{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cookieJar.Close()
+		cookieJar = nil
+	}()
+	u, _ := url.Parse("https://www.google.com/")
+	s := &Session{}
+	h := make(http.Header)
+	s.storeCookies(u, []*http.Cookie{
+		{Name: "gone", Value: NULL, MaxAge: -1},
+		{Name: "evil", Value: "1", Domain: "example.com"},
+	}, h)
+	if s.jar != nil || len(cookieJar.sessions) != 0 || len(h) != 0 {
+		t.Fatalf("session created for no kept cookie")
+	}
+	s.storeCookies(u, []*http.Cookie{{Name: "NID", Value: "1"}}, h)
+	if s.jar == nil || len(cookieJar.sessions) != 1 || h.Get("Set-Cookie") == NULL {
+		t.Errorf("no session for a kept cookie")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// upstreamUrl maps the proxy url of this session back to the upstream url,
+// nil if ref is not a proxy url or is outside of the DomainRestriction.
+func (s *Session) upstreamUrl(ref string) *url.URL {
+	u, err := url.Parse(ref)
+	if err != nil || !strings.EqualFold(u.Host, s.aHost) {
+		return nil
+	}
+	var host, path = default_host, u.Path
+	if strings.HasPrefix(path, "/!") {
+		host, path = path[2:], "/"
+		if i := strings.IndexByte(host, '/'); i >= 0 {
+			host, path = host[:i], host[i:]
+		}
+	}
+	if host == NULL || !config.CheckDomainRestriction(host) {
+		return nil
+	}
+	return &url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     path,
+		RawQuery: u.RawQuery,
+	}
+}
+
+// upstreamOrigin translates the Origin of the proxy page to the origin of
+// the upstream page found by referer, empty if the origin is foreign.
+func (s *Session) upstreamOrigin(origin, referer string) string {
+	if !strings.EqualFold(origin, s.proxyOrigin()) {
+		return NULL
+	}
+	if ref := s.upstreamUrl(referer); ref != nil {
+		return ref.Scheme + "://" + ref.Host
+	}
+	return default_protocol + default_host
+}
+
+// translateCors replaces the upstream origins allowed by the response
+// with the proxy origin.
+func (s *Session) translateCors(h http.Header) {
+	var origin = s.proxyOrigin()
+	for _, k := range []string{"Access-Control-Allow-Origin", "Timing-Allow-Origin"} {
+		for i, v := range h[k] {
+			var values = strings.Fields(strings.Replace(v, ",", " ", -1))
+			for j, o := range values {
+				if u, err := url.Parse(o); err == nil && u.Host != NULL && config.CheckDomainRestriction(u.Host) {
+					values[j] = origin
+				}
+			}
+			h[k][i] = strings.Join(values, ", ")
+		}
+	}
+}
+
+// preflight answers the CORS preflight requests from the proxy origin,
+// the actual requests are checked by upstream with the translated Origin.
+func (s *Session) preflight(w http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	method := req.Header.Get("Access-Control-Request-Method")
+	if s.aMethod != "OPTIONS" || origin == NULL || method == NULL {
+		return false
+	}
+	if !strings.EqualFold(origin, s.proxyOrigin()) {
+		outputError(w, errNotAllowed)
+		return true
+	}
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Allow-Methods", method)
+	if headers := req.Header.Get("Access-Control-Request-Headers"); headers != NULL {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	h.Set("Access-Control-Allow-Credentials", "true")
+	h.Set("Access-Control-Max-Age", "600")
+	h.Set("Vary", "Origin")
+	w.WriteHeader(204)
+	return true
+}
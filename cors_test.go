@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpstreamOrigin(t *testing.T) {
+	initTestConfig()
+	s := &Session{aProto: "https", aHost: "px.example"}
+	samples := []struct {
+		origin, referer, upstream string
+	}{
+		{"https://px.example", "https://px.example/!ssl.gstatic.com/x?y", "https://ssl.gstatic.com"},
+		{"https://px.example", "https://px.example/search?q=1", "https://www.google.com"},
+		{"https://px.example", NULL, "https://www.google.com"},
+		{"https://px.example", "https://px.example/!example.com/", "https://www.google.com"},
+		{"https://evil.example", "https://px.example/", NULL},
+		{"null", NULL, NULL},
+	}
+	for _, sa := range samples {
+		if o := s.upstreamOrigin(sa.origin, sa.referer); o != sa.upstream {
+			t.Errorf("origin=%s referer=%s upstream=%s", sa.origin, sa.referer, o)
+		}
+	}
+	if u := s.upstreamUrl("https://px.example/!ssl.gstatic.com"); u == nil || u.String() != "https://ssl.gstatic.com/" {
+		t.Errorf("upstream=%v", u)
+	}
+}
+
+func TestTranslateCors(t *testing.T) {
+	initTestConfig()
+	s := &Session{aProto: "https", aHost: "px.example"}
+	h := http.Header{
+		"Access-Control-Allow-Origin": {"https://www.google.com"},
+		"Timing-Allow-Origin":         {"https://www.google.com, https://example.com"},
+	}
+	s.translateCors(h)
+	if h.Get("Access-Control-Allow-Origin") != "https://px.example" || h.Get("Timing-Allow-Origin") != "https://px.example, https://example.com" {
+		t.Errorf("header=%v", h)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	s := &Session{aProto: "https", aHost: "px.example", aMethod: "OPTIONS"}
+	req := httptest.NewRequest("OPTIONS", "https://px.example/!ssl.gstatic.com/x", nil)
+	req.Header.Set("Origin", "https://px.example")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "x-goog-ext")
+	w := httptest.NewRecorder()
+	if !s.preflight(w, req) || w.Code != 204 || w.Header().Get("Access-Control-Allow-Headers") != "x-goog-ext" {
+		t.Errorf("code=%d header=%v", w.Code, w.Header())
+	}
+	req.Header.Set("Origin", "https://evil.example")
+	w = httptest.NewRecorder()
+	if !s.preflight(w, req) || w.Code != 403 {
+		t.Errorf("foreign code=%d", w.Code)
+	}
+}
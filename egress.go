@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	egressRoundRobin   = "round-robin"
+	egressLeastBlocked = "least-recently-blocked"
+	egressSticky       = "sticky"
+
+	ipv6Prefer = 1
+	ipv6Avoid  = -1
+)
+
+type EgressConfig struct {
+	// local source addresses of the upstream connections,
+	// empty lets the kernel choose
+	Addresses []string
+	// addresses derived from each prefix, e.g. 2001:db8::/64, the prefix
+	// must be routed to this host
+	Prefixes        []string
+	PrefixAddresses int
+	// round-robin, least-recently-blocked or sticky (per client session)
+	Strategy string
+	// comma-list of upstream-host-glob=prefer|avoid
+	IPv6 []string
+	ipv6 []ipv6Rule
+}
+
+type ipv6Rule struct {
+	host string
+	pref int
+}
+
+func defaultEgressConfig() EgressConfig {
+	return EgressConfig{
+		PrefixAddresses: 16,
+		Strategy:        egressRoundRobin,
+	}
+}
+
+func (c *EgressConfig) init() error {
+	switch c.Strategy {
+	case egressRoundRobin, egressLeastBlocked, egressSticky:
+	default:
+		return fmt.Errorf("Egress.Strategy: unknown value %q", c.Strategy)
+	}
+	for _, r := range trimList(c.IPv6) {
+		kv := strings.SplitN(r, "=", 2)
+		var rule = ipv6Rule{host: strings.ToLower(strings.TrimSpace(kv[0]))}
+		if len(kv) == 2 {
+			switch strings.TrimSpace(kv[1]) {
+			case "prefer":
+				rule.pref = ipv6Prefer
+			case "avoid":
+				rule.pref = ipv6Avoid
+			}
+		}
+		if rule.pref == 0 {
+			return fmt.Errorf("Egress.IPv6: expected host=prefer|avoid, got %q", r)
+		}
+		c.ipv6 = append(c.ipv6, rule)
+	}
+	return nil
+}
+
+// ipv6Preference returns the preference of the first rule matching host
+func (c *EgressConfig) ipv6Preference(host string) int {
+	host = canonicalHost(host)
+	for _, r := range c.ipv6 {
+		if globMatch(r.host, host) {
+			return r.pref
+		}
+	}
+	return 0
+}
+
+// addresses returns the configured and derived local addresses
+func (c *EgressConfig) addresses() ([]net.IP, error) {
+	var ips []net.IP
+	for _, a := range trimList(c.Addresses) {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("Egress.Addresses: invalid address %q", a)
+		}
+		ips = append(ips, ip)
+	}
+	for _, p := range trimList(c.Prefixes) {
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("Egress.Prefixes: %v", err)
+		}
+		for i := 0; i < c.PrefixAddresses; i++ {
+			ips = append(ips, prefixAddress(n, i))
+		}
+	}
+	return ips, nil
+}
+
+// prefixAddress derives the i-th stable host address of the prefix n
+func prefixAddress(n *net.IPNet, i int) net.IP {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s#%d", n, i)))
+	ip := make(net.IP, len(n.IP))
+	for j := range ip {
+		ip[j] = n.IP[j] | sum[j]&^n.Mask[j]
+	}
+	return ip
+}
+
+type egressAddr struct {
+	ip        net.IP
+	key       string
+	v6        bool
+	transport *http.Transport
+}
+
+// EgressPool is a RoundTripper sending each request from a local address
+// selected by the strategy, every address has its own connections.
+type EgressPool struct {
+	conf  *EgressConfig
+	addrs []*egressAddr
+	next  uint32
+}
+
+var egressPool *EgressPool
+
+type egressContextKey struct{}
+
+func newTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Transport {
+	return &http.Transport{
+		Proxy:               nil,
+		DialContext:         dial,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConnsPerHost: 256,
+	}
+}
+
+func NewEgressPool(conf *EgressConfig) (*EgressPool, error) {
+	ips, err := conf.addresses()
+	if err != nil || len(ips) == 0 {
+		return nil, err
+	}
+	p := &EgressPool{conf: conf}
+	for _, ip := range ips {
+		e := &egressAddr{ip: ip, key: ip.String(), v6: ip.To4() == nil}
+		dialer := &net.Dialer{
+			Timeout:   baseDialer.Timeout,
+			KeepAlive: baseDialer.KeepAlive,
+			LocalAddr: &net.TCPAddr{IP: ip},
+		}
+		network := "tcp4"
+		if e.v6 {
+			network = "tcp6"
+		}
+		e.transport = newTransport(func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		})
+		p.addrs = append(p.addrs, e)
+	}
+	return p, nil
+}
+
+// withEgressSession binds req to the sticky egress of the client key,
+// or to the blocked egress if the client is solving the CAPTCHA.
+func withEgressSession(req *http.Request, key string) *http.Request {
+	req = req.WithContext(context.WithValue(req.Context(), egressContextKey{}, key))
+	return withEgressPin(req, key)
+}
+
+// candidates returns the addresses of the preferred family which are not
+// blocked, all of them if every one is blocked.
+func (p *EgressPool) candidates(host string, now time.Time) []*egressAddr {
+	var pref = p.conf.ipv6Preference(host)
+	var preferred, others []*egressAddr
+	for _, e := range p.addrs {
+		if abuseTracker.Blocked(e.key, now) {
+			continue
+		}
+		if pref == ipv6Prefer && e.v6 || pref == ipv6Avoid && !e.v6 {
+			preferred = append(preferred, e)
+		} else {
+			others = append(others, e)
+		}
+	}
+	switch {
+	case len(preferred) > 0:
+		return preferred
+	case len(others) > 0:
+		return others
+	}
+	return p.addrs
+}
+
+func (p *EgressPool) pick(host, session string, now time.Time) *egressAddr {
+	var addrs = p.candidates(host, now)
+	var n = atomic.AddUint32(&p.next, 1)
+	switch p.conf.Strategy {
+	case egressSticky:
+		h := fnv.New32a()
+		h.Write([]byte(session))
+		return addrs[h.Sum32()%uint32(len(addrs))]
+	case egressLeastBlocked:
+		// start at the round-robin position to spread the ties
+		var best *egressAddr
+		var bestTime time.Time
+		for i := range addrs {
+			e := addrs[(int(n)+i)%len(addrs)]
+			if t := abuseTracker.LastBlock(e.key); best == nil || t.Before(bestTime) {
+				best, bestTime = e, t
+			}
+		}
+		return best
+	}
+	return addrs[n%uint32(len(addrs))]
+}
+
+// route returns the pinned address of req if it is in the pool,
+// otherwise the one picked by the strategy.
+func (p *EgressPool) route(req *http.Request) *egressAddr {
+	if pin := pinnedEgress(req); pin != NULL {
+		for _, e := range p.addrs {
+			if e.key == pin {
+				return e
+			}
+		}
+	}
+	session, _ := req.Context().Value(egressContextKey{}).(string)
+	return p.pick(req.URL.Host, session, time.Now())
+}
+
+func (p *EgressPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	return p.route(req).transport.RoundTrip(req)
+}
+
+func (p *EgressPool) CloseIdleConnections() {
+	for _, e := range p.addrs {
+		e.transport.CloseIdleConnections()
+	}
+}
+
+// egressSession returns the key of the sticky egress of the client
+func (s *Session) egressSession() string {
+	if s.sid != NULL {
+		return s.sid
+	}
+	if host, _, err := net.SplitHostPort(s.aAddr); err == nil {
+		return host
+	}
+	return s.aAddr
+}
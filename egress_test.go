@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestEgressPool(t *testing.T, strategy string, addrs ...string) *EgressPool {
+	config = new(AppConfig)
+	config.abuse = defaultAbuseConfig()
+	config.egress = defaultEgressConfig()
+	config.egress.Strategy = strategy
+	config.egress.Addresses = addrs
+	config.egress.IPv6 = []string{"*.gstatic.com=prefer", "www.google.com=avoid"}
+	if err := config.egress.init(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewEgressPool(&config.egress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestEgressPrefix(t *testing.T) {
+	_, n, _ := net.ParseCIDR("2001:db8:1::/64")
+	seen := make(map[string]bool)
+	for i := 0; i < 16; i++ {
+		ip := prefixAddress(n, i)
+		if !n.Contains(ip) || seen[ip.String()] {
+			t.Fatalf("address %d: %s", i, ip)
+		}
+		if !ip.Equal(prefixAddress(n, i)) {
+			t.Fatalf("address %d is not stable", i)
+		}
+		seen[ip.String()] = true
+	}
+	conf := defaultEgressConfig()
+	conf.Strategy = "random"
+	if conf.init() == nil {
+		t.Errorf("unknown strategy accepted")
+	}
+	conf = defaultEgressConfig()
+	conf.IPv6 = []string{"www.google.com"}
+	if conf.init() == nil {
+		t.Errorf("rule without preference accepted")
+	}
+}
+
+func TestEgressPick(t *testing.T) {
+	saved := abuseTracker
+	defer func() { abuseTracker = saved }()
+	abuseTracker = &AbuseTracker{egress: make(map[string]*egressState)}
+	now := time.Now()
+
+	p := newTestEgressPool(t, egressRoundRobin, "192.0.2.1", "192.0.2.2", "2001:db8::1")
+	if e := p.pick("www.google.com:443", NULL, now); e.v6 {
+		t.Errorf("ipv6 egress for avoided host")
+	}
+	for i := 0; i < 3; i++ {
+		if e := p.pick("ssl.gstatic.com:443", NULL, now); e.key != "2001:db8::1" {
+			t.Errorf("preferred ipv6 not picked: %s", e.key)
+		}
+	}
+	var counts = make(map[string]int)
+	for i := 0; i < 30; i++ {
+		counts[p.pick("scholar.google.com", NULL, now).key]++
+	}
+	if len(counts) != 3 || counts["192.0.2.1"] != 10 {
+		t.Errorf("round-robin counts %v", counts)
+	}
+
+	// blocked addresses are skipped unless all are blocked
+	abuseTracker.Report("2001:db8::1", abuseSorry, now)
+	if e := p.pick("ssl.gstatic.com", NULL, now); e.v6 {
+		t.Errorf("blocked egress picked")
+	}
+	abuseTracker.Report("192.0.2.1", abuseSorry, now)
+	abuseTracker.Report("192.0.2.2", abuseSorry, now)
+	if e := p.pick("ssl.gstatic.com", NULL, now); e == nil {
+		t.Errorf("no egress while all blocked")
+	}
+
+	p = newTestEgressPool(t, egressLeastBlocked, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+	later := now.Add(2 * config.abuse.BlockTime)
+	abuseTracker.Report("192.0.2.1", abuseSorry, now.Add(time.Minute))
+	abuseTracker.Report("192.0.2.2", abuseSorry, now)
+	abuseTracker.Report("192.0.2.3", abuseSorry, now.Add(2*time.Minute))
+	for i := 0; i < 3; i++ {
+		if e := p.pick("www.google.com", NULL, later); e.key != "192.0.2.2" {
+			t.Errorf("least recently blocked: %s", e.key)
+		}
+	}
+
+	p = newTestEgressPool(t, egressSticky, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+	for i := 0; i < 10; i++ {
+		session := fmt.Sprint("client", i)
+		first := p.pick("www.google.com", session, later)
+		for j := 0; j < 3; j++ {
+			if e := p.pick("www.google.com", session, later); e != first {
+				t.Errorf("session %s moved from %s to %s", session, first.key, e.key)
+			}
+		}
+	}
+}
+
+func TestEgressBind(t *testing.T) {
+	var remote = make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		remote <- host
+	}))
+	defer ts.Close()
+
+	p := newTestEgressPool(t, egressRoundRobin, "127.0.0.2", "127.0.0.3")
+	defer p.CloseIdleConnections()
+	client := &http.Client{Transport: p}
+	for i := 0; i < 4; i++ {
+		var egress string
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		resp, err := client.Do(traceEgress(req, &egress))
+		if err != nil {
+			t.Skip("loopback aliases are not bindable:", err)
+		}
+		resp.Body.Close()
+		if r := <-remote; r != egress || r != p.addrs[(i+1)%2].key {
+			t.Errorf("request %d from %s, traced %s", i, r, egress)
+		}
+	}
+}
+
+func TestEgressPin(t *testing.T) {
+	saved := abuseTracker
+	defer func() { abuseTracker = saved }()
+	abuseTracker = &AbuseTracker{egress: make(map[string]*egressState)}
+	now := time.Now()
+
+	p := newTestEgressPool(t, egressRoundRobin, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+	abuseTracker.Report("192.0.2.2", abuseSorry, now)
+	abuseTracker.Pin("client", "192.0.2.2", now)
+	for _, path := range []string{"/sorry/index", "/sorry/image", "/sorry/index"} {
+		req, _ := http.NewRequest("GET", "https://www.google.com"+path, nil)
+		if e := p.route(withEgressSession(req, "client")); e.key != "192.0.2.2" {
+			t.Errorf("%s not pinned to the blocked egress: %s", path, e.key)
+		}
+	}
+	req, _ := http.NewRequest("GET", "https://www.google.com/search", nil)
+	for i := 0; i < 3; i++ {
+		if e := p.route(withEgressSession(req, "client")); e.key == "192.0.2.2" {
+			t.Errorf("search sent from the blocked egress")
+		}
+	}
+	req, _ = http.NewRequest("GET", "https://www.google.com/sorry/index", nil)
+	if pinnedEgress(withEgressSession(req, "other")) != NULL {
+		t.Errorf("other client pinned")
+	}
+	if abuseTracker.Pinned("client", now.Add(config.abuse.BlockTime)) != NULL {
+		t.Errorf("pin not expired")
+	}
+	abuseTracker.Unpin("client")
+	if pinnedEgress(withEgressSession(req, "client")) != NULL {
+		t.Errorf("pin not dropped")
+	}
+}
@@ -9,9 +9,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Lafeng/ezgoo/glog"
 )
@@ -23,14 +23,11 @@ const (
 	maxAcceptedLength = 2 << 20
 )
 
-var (
-	reAbuseRedirect = regexp.MustCompile(`ipv\d\.google\.com/sorry`)
-)
-
 type JsonObject map[string]interface{}
 
 type ezgooServer struct {
 	proto string
+	serv  *AppServ
 }
 
 func outputError(w http.ResponseWriter, err error) {
@@ -38,6 +35,8 @@ func outputError(w http.ResponseWriter, err error) {
 	w.Header().Del("Content-Length")
 	if err == errNotAllowed {
 		w.WriteHeader(403)
+	} else if err == errTooLarge {
+		w.WriteHeader(413)
 	} else {
 		w.WriteHeader(500)
 	}
@@ -58,12 +57,14 @@ type Session struct {
 	aPort      int
 	aMethod    string
 	plainHost  string
-	abusing    bool
 	redirected bool
+	sid        string         // ezgoo session of the cookie jar
+	jar        *CookieSession // nil if the jar is disabled or no session
+	serv       *AppServ       // the listener
 }
 
 func (x *ezgooServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	se := NewSession(req)
+	se := NewSession(req, x.serv)
 	se.aProto = x.proto
 	if se.Preprocess(w, req) {
 		log.Infof("%s %s %s [PASS] %s", se.aAddr, se.aMethod, se.dUserAgent, req.URL.String())
@@ -80,7 +81,7 @@ func (x *ezgooServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func NewSession(req *http.Request) *Session {
+func NewSession(req *http.Request, serv *AppServ) *Session {
 	s := &Session{
 		dAddr:      req.RemoteAddr,
 		dMethod:    req.Method,
@@ -92,8 +93,9 @@ func NewSession(req *http.Request) *Session {
 		aHost:      req.Host,
 		aPort:      -1,
 		aMethod:    req.Method,
+		serv:       serv,
 	}
-	if config.TrustProxy {
+	if s.trustProxy() {
 		s.DetermineActualRequest(req)
 	}
 	// :port in host
@@ -105,6 +107,21 @@ func NewSession(req *http.Request) *Session {
 	return s
 }
 
+// forceHttps and trustProxy fall back to [Basic] without listener
+func (s *Session) forceHttps() bool {
+	if s.serv != nil {
+		return s.serv.ForceHttps
+	}
+	return config.ForceHttps
+}
+
+func (s *Session) trustProxy() bool {
+	if s.serv != nil {
+		return s.serv.TrustProxy
+	}
+	return config.TrustProxy
+}
+
 func (s *Session) DetermineActualRequest(req *http.Request) {
 	aProto := req.Header.Get("X-Forwarded-Proto")
 	if aProto != NULL {
@@ -132,7 +149,7 @@ func (s *Session) DetermineActualRequest(req *http.Request) {
 	cf_vistor := req.Header.Get("cf-visitor")
 	if cf_vistor != NULL {
 		jsonObj := make(JsonObject)
-		if err := json.Unmarshal([]byte(cf_vistor), jsonObj); err == nil {
+		if err := json.Unmarshal([]byte(cf_vistor), &jsonObj); err == nil {
 			if scheme := jsonObj["scheme"]; scheme != nil {
 				s.aProto = scheme.(string)
 			}
@@ -141,40 +158,33 @@ func (s *Session) DetermineActualRequest(req *http.Request) {
 }
 
 func (s *Session) Preprocess(w http.ResponseWriter, req *http.Request) (accept bool) {
-	switch s.url.Path {
-	case "/url":
-		next := req.FormValue("url")
-		if next != NULL {
-			http.Redirect(w, req, next, 302)
-			accept = true
-			return
-		}
-	case "/setprefdomain":
-		http.Redirect(w, req, "/", 301)
-		accept = true
-		return
-
-	case "/robots.txt":
-		w.WriteHeader(200)
-		fmt.Fprint(w, robots_response)
-		accept = true
-		return
-		/*
-			case "/gen_204":
-				w.WriteHeader(204)
-				accept = true
-				return
-		*/
+	// exempt from the client restriction: the ACME validation servers, the
+	// metrics limited by their own Addresses, the crawlers reading robots.txt
+	// and the HEAD health checks answered without a body
+	if s.serveChallenge(w, req) {
+		return true
 	}
-	if s.aMethod == "HEAD" {
-		w.WriteHeader(200)
+	if s.serveMetrics(w, req) {
 		return true
 	}
-	if !config.CheckClientRestriction(s, req) {
+	if s.url.Path == "/robots.txt" && s.serveRoute(w, req) {
+		return true
+	}
+	if s.aMethod != "HEAD" && !config.CheckClientRestriction(s, req) {
 		outputError(w, errNotAllowed)
 		return true
 	}
-	if config.ForceHttps && s.aProto != "https" {
+	if s.preflight(w, req) {
+		return true
+	}
+	if s.serveRoute(w, req) {
+		return true
+	}
+	if s.aMethod == "HEAD" {
+		w.WriteHeader(200)
+		return true
+	}
+	if s.forceHttps() && s.aProto != "https" {
 		req.URL.Scheme = "https"
 		// URL.Host is blank
 		req.URL.Host = s.aHost
@@ -190,6 +200,9 @@ type PxReq struct {
 	url        *url.URL
 	nondefault int
 	header     http.Header
+	policy     headerPolicySet
+	body       io.Reader // rewritten request body
+	egress     string    // local address of the upstream connection
 	tmpDest    string
 }
 
@@ -214,46 +227,83 @@ func (s *Session) buildPxReq(req *http.Request) (xReq *PxReq, err error) {
 	}
 
 	// process in-Header
-	// copy header, skip Cookie
+	// copy header, skip Cookie, hop-by-hop and the denied
+	var policy = config.headerPolicies.Select(dst)
+	var hop = connectionHeaders(req.Header)
+	var origin = s.upstreamOrigin(req.Header.Get("Origin"), req.Header.Get("Referer"))
 	for k, vv := range req.Header {
 		switch k {
+		case "Origin":
+			if origin == NULL {
+				continue
+			}
+			vv = []string{origin}
 		case "Referer":
-			ref := vv[0]
-			if pos := strings.Index(ref, "/!"); pos > 0 {
-				ref = default_protocol + ref[pos+2:]
-				vv[0] = ref
-			} else {
+			ref := s.translateReferer(vv[0], policy.refererPolicy())
+			if ref == NULL {
 				continue
 			}
-		case "Cookie", "Origin":
+			vv = []string{ref}
+		case "Cookie":
 			continue
 		default:
-			if strings.HasPrefix(k, "X-") {
+			if hop[k] || !policy.forward(phaseRequest, k) {
 				continue
 			}
 		}
 		xHeader[k] = vv
 	}
+	if config.privacy.Enabled {
+		config.privacy.privatizeRequest(dst, xHeader)
+	}
+	policy.apply(phaseRequest, xHeader)
 
 	// process in-Cookies
 	// copy cookies, skip namesakes if requested to nondefault domain
 	var cookies []string
-	for _, ck := range req.Cookies() {
-		if nondef > 0 {
-			if ckNames[ck.Name] {
-				if debug {
-					log.Warningf("cookie dup??? uri=%s exists=[%s] %s==%s", uri, strings.Join(cookies, "]["), ck.Name, ck.Value)
+	if cookieJar != nil {
+		// the browser holds only the ezgoo cookie
+		s.sid, s.jar = cookieJar.Lookup(req)
+		if s.jar != nil {
+			for _, ck := range s.jar.Cookies(dst) {
+				cookies = append(cookies, ck.String())
+			}
+		}
+	} else {
+		for _, ck := range req.Cookies() {
+			if nondef > 0 {
+				if ckNames[ck.Name] {
+					if debug {
+						log.Warningf("cookie dup??? uri=%s exists=[%s] %s==%s", uri, strings.Join(cookies, "]["), ck.Name, ck.Value)
+					}
+					continue
+				} else {
+					ckNames[ck.Name] = true
 				}
+			}
+			// ignore __cookie
+			if strings.HasPrefix(ck.Name, "__") {
 				continue
-			} else {
-				ckNames[ck.Name] = true
 			}
+			if cookieCipher != nil {
+				// the cookies of the default host are sent along
+				value, ok := cookieCipher.Open(ck.Name, cookieScope(NULL), ck.Value)
+				if !ok && nondef > 0 {
+					value, ok = cookieCipher.Open(ck.Name, cookieScope(dst.Host), ck.Value)
+				}
+				if !ok {
+					if log.V(1) {
+						log.Warningf("%s reject cookie %s", s.aAddr, ck.Name)
+					}
+					continue
+				}
+				ck.Value = value
+			}
+			cookies = append(cookies, ck.String())
 		}
-		// ignore __cookie
-		if strings.HasPrefix(ck.Name, "__") {
-			continue
-		}
-		cookies = append(cookies, ck.String())
+	}
+	if prefDomPool != nil && config.prefDom.Inject {
+		cookies = prefDomPool.inject(dst, cookies)
 	}
 	if len(cookies) > 0 {
 		xHeader.Set("Cookie", strings.Join(cookies, "; "))
@@ -262,11 +312,10 @@ func (s *Session) buildPxReq(req *http.Request) (xReq *PxReq, err error) {
 	if !config.CheckDomainRestriction(dst.Host) {
 		return nil, errNotAllowed
 	}
-
-	// ipv[46]
-	if nondef > 0 && reAbuseRedirect.MatchString(uri) {
-		nondef |= 0xf0
-		s.abusing = true
+	dst.RawQuery = s.rewriteParams(dst.RawQuery)
+	body, err := s.rewriteForm(req.Header.Get("Content-Type"), s.body)
+	if err != nil {
+		return nil, err
 	}
 
 	xHeader.Set("Connection", "keep-alive")
@@ -276,6 +325,10 @@ func (s *Session) buildPxReq(req *http.Request) (xReq *PxReq, err error) {
 		url:        dst,
 		nondefault: nondef,
 		header:     xHeader,
+		policy:     policy,
+	}
+	if body != nil {
+		xReq.body = body
 	}
 	return
 }
@@ -284,14 +337,18 @@ func (s *Session) doProxy(xReq *PxReq, w http.ResponseWriter) (err error) {
 	var req *http.Request
 	var resp *http.Response
 
-	req, err = NewRequest(s.dMethod, xReq.url, s.body)
+	var body io.Reader = s.body
+	if xReq.body != nil {
+		body = xReq.body
+	}
+	req, err = NewRequest(s.dMethod, xReq.url, body)
 	req.Header = xReq.header
 
 	if log.V(3) {
 		dumpHeader("<- Header/ActualReq", req.Header)
 	}
 
-	resp, err = http_client.Do(req)
+	resp, err = s.roundTrip(xReq, req, w.Header())
 
 	if log.V(1) {
 		if resp != nil {
@@ -308,16 +365,39 @@ func (s *Session) doProxy(xReq *PxReq, w http.ResponseWriter) (err error) {
 		defer resp.Body.Close()
 	}
 	if err != nil {
-		if e, y := err.(*url.Error); y && e.Err == err30xRedirect {
+		if isRedirectError(err) {
 			s.redirected, err = true, nil
 		} else {
 			return dumpError(err)
 		}
 	}
 
+	abuse := detectAbuse(resp)
+	if abuse != NULL {
+		abuseTracker.Report(xReq.egress, abuse, time.Now())
+	} else if captchaSolved(resp) {
+		abuseTracker.Clear(xReq.egress)
+		abuseTracker.Unpin(s.egressSession())
+	}
+
 	err = s.processOutputHeader(xReq, resp, w)
-	if err != nil {
+	// after the output header which may give the client a jar session
+	if abuse == abuseSorry || abuse == abuseCaptcha {
+		abuseTracker.Pin(s.egressSession(), xReq.egress, time.Now())
+	}
+	if err == nil && (abuse == abuseSorry || abuse == abuseLimited) {
+		var location string
+		if abuse == abuseSorry {
+			location = w.Header().Get("Location")
+		}
+		if s.serveInterstitial(w, xReq.header.Get("Accept"), location) {
+			return
+		}
+	}
+	if err == bad_cr {
 		err = s.avoidCountryRedirect(xReq, w)
+	}
+	if err != nil {
 		return
 	}
 
@@ -333,26 +413,16 @@ func (s *Session) doProxy(xReq *PxReq, w http.ResponseWriter) (err error) {
 }
 
 func (s *Session) processOutputHeader(xReq *PxReq, resp *http.Response, w http.ResponseWriter) (err error) {
-	defer func() {
-		if e := recover(); e != nil {
-			err = e.(error)
-		}
-	}()
 	wHeader := w.Header()
+	hop := connectionHeaders(resp.Header)
 	for k, array := range resp.Header {
 		switch k {
 		case "Set-Cookie":
 			continue
 		case "Location":
-			targetUrl := array[0]
-			nextUrl := s.processRedirect(targetUrl)
-			if log.V(1) {
-				log.Infof("Cook redirection %s -> %s", targetUrl, nextUrl)
-			}
-			wHeader.Set(k, nextUrl)
+			wHeader.Set(k, array[0])
 		default:
-			// Alt-Svc, Alternate-Protocol
-			if strings.HasPrefix(k, "Alt") {
+			if hop[k] || !xReq.policy.forward(phaseResponse, k) {
 				continue
 			}
 			for _, v := range array {
@@ -361,64 +431,46 @@ func (s *Session) processOutputHeader(xReq *PxReq, resp *http.Response, w http.R
 		}
 	}
 
+	targetUrl := wHeader.Get("Location")
+	if NewUrlMapper(xReq.url).mapHeaders(wHeader) {
+		return bad_cr
+	}
+	if targetUrl != NULL && log.V(1) {
+		log.Infof("Cook redirection %s -> %s", targetUrl, wHeader.Get("Location"))
+	}
+
 	wHeader.Set("Server", "ezgoo")
-	wHeader.Set("Referrer-Policy", "no-referrer")
+	// referer is translated for upstream and never leaves the proxy
+	wHeader.Set("Referrer-Policy", "same-origin")
+	s.secureHeaders(wHeader)
+	s.translateCors(wHeader)
+	if config.privacy.Enabled {
+		config.privacy.privatizeResponse(wHeader)
+	}
+	xReq.policy.apply(phaseResponse, wHeader)
+	if cookieJar != nil {
+		s.storeCookies(xReq.url, resp.Cookies(), wHeader)
+		return
+	}
 	var alterCookiePath = xReq.nondefault == 0xf
 	for _, ck := range resp.Cookies() {
+		var scope = cookieScope(NULL)
 		if alterCookiePath {
 			if ck.Domain == NULL || strings.HasPrefix(ck.Domain, ".") {
 				// prevent ck.path==/!.some-host
-				ck.Path = fmt.Sprintf("/!%s%s", xReq.url.Host, ck.Path)
+				scope = cookieScope(xReq.url.Host)
 			} else {
-				ck.Path = fmt.Sprintf("/!%s%s", ck.Domain, ck.Path)
+				scope = cookieScope(ck.Domain)
 			}
+			ck.Path = scope + ck.Path
 		}
-		if v := cookieString(ck, &s.plainHost, true); v != NULL {
+		if v := cookieString(ck, scope, &s.plainHost, true); v != NULL {
 			wHeader.Add("Set-Cookie", v)
 		}
 	}
 	return
 }
 
-func (s *Session) processRedirect(target string) string {
-	uri, _ := url.Parse(target)
-	/*
-		// prevent redirecting to country site
-		// 1. ncr
-		if uri.Path == "/" && strings.Contains(uri.RawQuery, "gfe_rd=cr") {
-			return "/ncr"
-		}
-		// 2. append _rd param by redirection or internal
-		if params.Get("gfe_rd") != NULL {
-			params.Set("gfe_rd", "cr")
-			params.Set("gws_rd", "cr")
-			return uri.Path + "?" + params.Encode()
-		}
-	*/
-	if uri.Path == s.url.Path && uri.Host != default_host {
-		if strings.Contains(target, "gfe_rd=") {
-			panic(bad_cr)
-		}
-	}
-	if config.CheckDomainRestriction(uri.Host) {
-		// maybe non-default domain
-		nondefault := uri.Host != default_host
-		if nondefault {
-			uri.Path = uri.Host + uri.Path
-		}
-		// relative url
-		uri.Scheme, uri.Host = NULL, NULL
-		target = uri.String()
-		if nondefault {
-			target = "/!" + target
-		}
-	}
-	if len(target) == 0 {
-		target = "/"
-	}
-	return target
-}
-
 type Handler int
 
 const (
@@ -452,13 +504,54 @@ func determineHandler(contentType string) Handler {
 	return HD_unknown
 }
 
+// applyRules runs the rules on body in order, a final rule skips the rest
+// rules of the section once it matches: its content pattern is found, or
+// it has none.
+func applyRules(rules []ReRule, reqPath string, body []byte) ([]byte, string) {
+	var bodyExtraHeader string
+	for i, r := range rules {
+		if r.PathRe != nil && r.PathRe.FindString(reqPath) == NULL {
+			if log.V(4) {
+				log.Infof("re.%d=[%s] pathRe=deny", i, r.Name)
+			}
+			continue
+		}
+		if log.V(4) {
+			log.Infof("re.%d=[%s] applied", i, r.Name)
+		}
+		var matched = r.ContentRe == nil
+		if r.ContentRe != nil {
+			if r.Scheme&0xff > 0 {
+				var n int
+				if r.replFn != nil {
+					body, n = r.ContentRe.ReplaceFunc(body, r.replFn)
+				} else {
+					body, n = r.ContentRe.Replace(body, r.Replacement)
+				}
+				matched = n > 0
+			} else if r.Final {
+				matched = r.ContentRe.Match(body)
+			}
+		}
+		if r.Scheme&0xff00 > 0 {
+			bodyExtraHeader += r.InsertHeader
+		}
+		if r.Final && matched {
+			if log.V(4) {
+				log.Infof("re.%d=[%s] final", i, r.Name)
+			}
+			break
+		}
+	}
+	return body, bodyExtraHeader
+}
+
 func (p Handler) processText(s *Session, w http.ResponseWriter, resp *http.Response) (err error) {
 	var (
 		zr      *gzip.Reader
 		zw      *gzip.Writer
 		body    []byte
 		gzipped bool   = resp.Header.Get("Content-Encoding") == "gzip"
-		reqHost string = resp.Request.URL.Host
 		reqPath string = resp.Request.URL.Path
 	)
 	if resp.ContentLength != 0 && resp.Request.Method != "HEAD" {
@@ -488,47 +581,26 @@ func (p Handler) processText(s *Session, w http.ResponseWriter, resp *http.Respo
 
 	var (
 		rules           []ReRule
+		ruleSet         = s.ruleSet()
 		bodyExtraHeader string
 	)
 
 	switch p {
 	case HD_html:
-		rules = reRules.Html
+		rules = ruleSet.Html
 	case HD_javascript:
-		rules = reRules.Js
+		rules = ruleSet.Js
 	case HD_json:
-		rules = reRules.Json
+		rules = ruleSet.Json
 	case HD_css:
-		rules = reRules.Css
+		rules = ruleSet.Css
 	}
 
 	if log.V(5) {
 		log.Infof("Original entity %s\n%s", reqPath, string(body))
 	}
 
-	if s.abusing {
-		imgSrc := fmt.Sprintf(`<img src="/!%s/sorry`, reqHost)
-		body = bytes.Replace(body, []byte(`<img src="/sorry`), []byte(imgSrc), 1)
-		rules = nil
-	}
-
-	for i, r := range rules {
-		if r.PathRe != nil && r.PathRe.FindString(reqPath) == NULL {
-			if log.V(4) {
-				log.Infof("re.%d=[%s] pathRe=deny", i, r.ContentPattern.Pattern)
-			}
-			continue
-		}
-		if log.V(4) {
-			log.Infof("re.%d=[%s] applied", i, r.ContentPattern.Pattern)
-		}
-		if r.Scheme&0xff > 0 {
-			body = r.ContentRe.Replace(body, r.Replacement)
-		}
-		if r.Scheme&0xff00 > 0 {
-			bodyExtraHeader += r.InsertHeader
-		}
-	}
+	body, bodyExtraHeader = applyRules(rules, reqPath, body)
 
 	zw = gzip.NewWriter(w)
 	if len(bodyExtraHeader) > 0 {
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Lafeng/ezgoo/regexp"
+	"github.com/go-ini/ini"
+)
+
+const (
+	phaseRequest = iota
+	phaseResponse
+)
+
+// headers are handled by ezgoo itself and never subject to the policy
+var managedHeaders = map[string]bool{
+	"Cookie":     true,
+	"Set-Cookie": true,
+	"Referer":    true,
+	"Location":   true,
+	"Origin":     true,
+}
+
+// RFC 7230 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type headerRewrite struct {
+	name string
+	re   *regexp.Regexp
+	repl string
+}
+
+type headerActions struct {
+	allow    []string
+	deny     []string
+	rewrites []headerRewrite
+	sets     [][2]string
+	adds     [][2]string
+}
+
+// HeaderPolicy declares how the headers are forwarded between the browser
+// and the upstream for the requests selected by Host and Path.
+type HeaderPolicy struct {
+	Name          string `ini:"-"`
+	Host          []string
+	Path          []string
+	RequestAllow  []string
+	RequestDeny   []string
+	ResponseAllow []string
+	ResponseDeny  []string
+	// translate, strip or origin-only
+	Referer string
+	phases  [2]headerActions
+}
+
+type HeaderPolicies []*HeaderPolicy
+
+// matched policies of a request, the default one first
+type headerPolicySet []*HeaderPolicy
+
+// used when the config has no [HeaderPolicy]
+func defaultHeaderPolicy() *HeaderPolicy {
+	hp := &HeaderPolicy{
+		Name:         "HeaderPolicy",
+		RequestDeny:  []string{"X-*"},
+		ResponseDeny: []string{"Alt-Svc", "Alternate-Protocol"},
+		Referer:      refererTranslate,
+	}
+	hp.init(nil)
+	return hp
+}
+
+var builtinHeaderPolicy = defaultHeaderPolicy()
+
+// initHeaderPolicies reads [HeaderPolicy] and every [HeaderPolicy.name],
+// the default policy comes first and the others keep the file order.
+func initHeaderPolicies(cfg *ini.File) (HeaderPolicies, error) {
+	var policies = HeaderPolicies{builtinHeaderPolicy}
+	for _, sec := range cfg.Sections() {
+		name := sec.Name()
+		var hp *HeaderPolicy
+		switch {
+		case name == "HeaderPolicy":
+			hp = defaultHeaderPolicy()
+			policies[0] = hp
+		case strings.HasPrefix(name, "HeaderPolicy."):
+			hp = &HeaderPolicy{Name: name}
+			policies = append(policies, hp)
+		default:
+			continue
+		}
+		if err := hp.init(sec); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return policies, nil
+}
+
+func (hp *HeaderPolicy) init(sec *ini.Section) error {
+	if sec != nil {
+		if err := sec.MapTo(hp); err != nil {
+			return err
+		}
+	}
+	if hp.Name == "HeaderPolicy" && len(hp.Host)+len(hp.Path) > 0 {
+		return fmt.Errorf("Host and Path are not allowed in the default policy")
+	}
+	hp.Host = globList(hp.Host)
+	switch hp.Referer {
+	case NULL, refererTranslate, refererStrip, refererOriginOnly:
+	default:
+		return fmt.Errorf("unknown Referer policy %q", hp.Referer)
+	}
+	for i, phase := range [2]string{"Request", "Response"} {
+		var a = &hp.phases[i]
+		if i == phaseRequest {
+			a.allow, a.deny = globList(hp.RequestAllow), globList(hp.RequestDeny)
+		} else {
+			a.allow, a.deny = globList(hp.ResponseAllow), globList(hp.ResponseDeny)
+		}
+		if sec == nil {
+			continue
+		}
+		for _, key := range sec.Keys() {
+			var action, header string
+			if dot := strings.IndexByte(key.Name(), '.'); dot > 0 && strings.HasPrefix(key.Name(), phase) {
+				action, header = key.Name()[len(phase):dot], http.CanonicalHeaderKey(key.Name()[dot+1:])
+			} else {
+				continue
+			}
+			if header == NULL || managedHeaders[header] {
+				return fmt.Errorf("%s: header can't be set", key.Name())
+			}
+			switch action {
+			case "Set":
+				a.sets = append(a.sets, [2]string{header, key.Value()})
+			case "Add":
+				a.adds = append(a.adds, [2]string{header, key.Value()})
+			case "Rewrite":
+				// pattern => replacement
+				parts := strings.SplitN(key.Value(), "=>", 2)
+				if len(parts) != 2 {
+					return fmt.Errorf("%s: expected pattern => replacement", key.Name())
+				}
+				re, err := regexp.Compile(strings.TrimSpace(parts[0]))
+				if err != nil {
+					return fmt.Errorf("%s: %v", key.Name(), err)
+				}
+				a.rewrites = append(a.rewrites, headerRewrite{header, re, strings.TrimSpace(parts[1])})
+			default:
+				return fmt.Errorf("%s: unknown action %s", key.Name(), action)
+			}
+		}
+	}
+	return nil
+}
+
+func globList(list []string) []string {
+	var globs = make([]string, 0, len(list))
+	for _, g := range list {
+		if g = strings.TrimSpace(g); g != NULL {
+			globs = append(globs, strings.ToLower(g))
+		}
+	}
+	return globs
+}
+
+// globMatch reports whether s matches pattern, '*' matches any sequence
+// and '?' matches any single byte.
+func globMatch(pattern, s string) bool {
+	var p, i, star, mark = 0, 0, -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case star >= 0:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func matchAny(globs []string, s string) bool {
+	for _, g := range globs {
+		if globMatch(g, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (hp *HeaderPolicy) match(u *url.URL) bool {
+	if len(hp.Host) > 0 && !matchAny(hp.Host, canonicalHost(u.Host)) {
+		return false
+	}
+	if len(hp.Path) > 0 && !matchAny(hp.Path, u.Path) {
+		return false
+	}
+	return true
+}
+
+// Select returns the policies applied to the upstream url u.
+func (hps HeaderPolicies) Select(u *url.URL) headerPolicySet {
+	if len(hps) == 0 {
+		return headerPolicySet{builtinHeaderPolicy}
+	}
+	var set = make(headerPolicySet, 0, 2)
+	for _, hp := range hps {
+		if hp.match(u) {
+			set = append(set, hp)
+		}
+	}
+	return set
+}
+
+// forward reports whether the header name passes, a header denied by any
+// policy passes only if some policy allows it.
+func (set headerPolicySet) forward(phase int, name string) bool {
+	name = strings.ToLower(name)
+	var denied bool
+	for _, hp := range set {
+		if matchAny(hp.phases[phase].allow, name) {
+			return true
+		}
+		denied = denied || matchAny(hp.phases[phase].deny, name)
+	}
+	return !denied
+}
+
+// refererPolicy returns the Referer policy of the last matched policy
+// declaring one.
+func (set headerPolicySet) refererPolicy() string {
+	var policy = refererTranslate
+	for _, hp := range set {
+		if hp.Referer != NULL {
+			policy = hp.Referer
+		}
+	}
+	return policy
+}
+
+// apply rewrites, sets and adds the static headers in policy order,
+// setting an empty value removes the header.
+func (set headerPolicySet) apply(phase int, h http.Header) {
+	for _, hp := range set {
+		a := &hp.phases[phase]
+		for _, rw := range a.rewrites {
+			for i, v := range h[rw.name] {
+				h[rw.name][i] = rw.re.ReplaceAllString(v, rw.repl)
+			}
+		}
+		for _, kv := range a.sets {
+			if kv[1] == NULL {
+				h.Del(kv[0])
+			} else {
+				h.Set(kv[0], kv[1])
+			}
+		}
+		for _, kv := range a.adds {
+			h.Add(kv[0], kv[1])
+		}
+	}
+}
+
+// connectionHeaders returns the hop-by-hop headers of h including the ones
+// listed in Connection.
+func connectionHeaders(h http.Header) map[string]bool {
+	var hop = make(map[string]bool, len(hopHeaders))
+	for _, k := range hopHeaders {
+		hop[k] = true
+	}
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != NULL {
+				hop[http.CanonicalHeaderKey(k)] = true
+			}
+		}
+	}
+	return hop
+}
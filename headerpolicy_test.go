@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+const headerPolicySample = `
+[HeaderPolicy]
+RequestDeny = Origin, X-*
+ResponseDeny = Alt-*, Link, Report-To
+ResponseSet.Server = test
+ResponseSet.Via =
+ResponseAdd.Vary = Origin
+
+[HeaderPolicy.data]
+Host = *.google.com
+Path = /complete/*
+RequestAllow = x-client-data
+RequestRewrite.Accept-Language = ^zh-CN => zh-TW
+`
+
+func TestHeaderPolicy(t *testing.T) {
+	cfg, err := ini.Load([]byte(headerPolicySample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := initHeaderPolicies(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := []struct {
+		url, header string
+		phase       int
+		forward     bool
+	}{
+		{"https://www.google.com/complete/search", "X-Client-Data", phaseRequest, true},
+		{"https://www.google.com/complete/search", "X-Other", phaseRequest, false},
+		{"https://www.google.com/search", "X-Client-Data", phaseRequest, false},
+		{"https://www.gstatic.com/complete/x", "X-Client-Data", phaseRequest, false},
+		{"https://www.google.com/search", "Origin", phaseRequest, false},
+		{"https://www.google.com/search", "Accept", phaseRequest, true},
+		{"https://www.google.com/search", "Alt-Svc", phaseResponse, false},
+		{"https://www.google.com/search", "Report-To", phaseResponse, false},
+		{"https://www.google.com/search", "Content-Type", phaseResponse, true},
+	}
+	for _, sa := range samples {
+		u, _ := url.Parse(sa.url)
+		if got := policies.Select(u).forward(sa.phase, sa.header); got != sa.forward {
+			t.Errorf("url=%s header=%s forward=%v", sa.url, sa.header, got)
+		}
+	}
+
+	u, _ := url.Parse("https://www.google.com/complete/search")
+	set := policies.Select(u)
+	h := http.Header{"Accept-Language": {"zh-CN,zh;q=0.8"}, "Via": {"1.1 x"}}
+	set.apply(phaseRequest, h)
+	set.apply(phaseResponse, h)
+	if h.Get("Accept-Language") != "zh-TW,zh;q=0.8" || h.Get("Server") != "test" || h.Get("Vary") != "Origin" || h["Via"] != nil {
+		t.Errorf("header=%v", h)
+	}
+
+	for _, bad := range []string{
+		"[HeaderPolicy]\nHost = x",
+		"[HeaderPolicy.a]\nRequestSet.Cookie = a=1",
+		"[HeaderPolicy.a]\nRequestRewrite.Accept = x",
+		"[HeaderPolicy.a]\nResponseDrop.Accept = x",
+	} {
+		cfg, _ := ini.Load([]byte(bad))
+		if _, err = initHeaderPolicies(cfg); err == nil {
+			t.Errorf("%q expected error", bad)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	samples := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"x-*", "x-client-data", true},
+		{"x-*", "accept", false},
+		{"*", NULL, true},
+		{"a?c", "abc", true},
+		{"*.google.com", "www.google.com", true},
+		{"*.google.com", "google.com", false},
+		{"/a/*/c", "/a/b/b/c", true},
+		{"/a/*/c", "/a/b/cd", false},
+	}
+	for _, sa := range samples {
+		if globMatch(sa.pattern, sa.s) != sa.match {
+			t.Errorf("glob %s %s expected %v", sa.pattern, sa.s, sa.match)
+		}
+	}
+}
+
+func TestConnectionHeaders(t *testing.T) {
+	h := http.Header{"Connection": {"keep-alive, x-foo"}}
+	hop := connectionHeaders(h)
+	if !hop["X-Foo"] || !hop["Keep-Alive"] || hop["Accept"] {
+		t.Errorf("hop=%v", hop)
+	}
+}
+
+func TestRefererPolicy(t *testing.T) {
+	cfg, _ := ini.Load([]byte("[HeaderPolicy]\n[HeaderPolicy.static]\nHost = *.gstatic.com\nReferer = strip\n"))
+	policies, err := initHeaderPolicies(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, expected := range map[string]string{"www.google.com": refererTranslate, "ssl.gstatic.com": refererStrip} {
+		if p := policies.Select(&url.URL{Host: host}).refererPolicy(); p != expected {
+			t.Errorf("host=%s referer=%s", host, p)
+		}
+	}
+	cfg, _ = ini.Load([]byte("[HeaderPolicy]\nReferer = full\n"))
+	if _, err = initHeaderPolicies(cfg); err == nil {
+		t.Errorf("expected error")
+	}
+}
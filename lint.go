@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/Lafeng/ezgoo/regexp"
+)
+
+type LintIssue struct {
+	File string
+	Line int
+	Msg  string
+	// a warning is accepted by the engine, an error stops the start
+	Warning bool
+}
+
+func (i *LintIssue) String() string {
+	var msg = i.Msg
+	if i.Warning {
+		msg = "warning: " + msg
+	}
+	if i.Line == 0 {
+		return fmt.Sprintf("%s: %s", i.File, msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", i.File, i.Line, msg)
+}
+
+// known elements of rules.xml and their attributes
+var lintSchema = map[string][]string{
+	"ReRules":        nil,
+	"Version":        nil,
+	"Html":           nil,
+	"Js":             nil,
+	"Json":           nil,
+	"Css":            nil,
+	"ReRule":         {"name", "group", "priority", "final", "dependsOn"},
+	"PathPattern":    {"flags"},
+	"ContentPattern": {"flags"},
+	"Replacement":    nil,
+	"InsertHeader":   nil,
+	"SchemeExpr":     nil,
+}
+
+// elements accepted by ReRule but never used by the engine
+var lintUnused = map[string]bool{
+	"InsertHeaderBak": true,
+}
+
+// position of a ReRule and of its child elements
+type ruleLoc struct {
+	line  int
+	elems map[string]int
+}
+
+type rulesLinter struct {
+	file   string
+	data   []byte
+	issues []*LintIssue
+	// section -> rules in file order
+	locs     map[string][]*ruleLoc
+	sections map[string]int
+}
+
+func (l *rulesLinter) report(line int, format string, args ...interface{}) {
+	l.issues = append(l.issues, &LintIssue{File: l.file, Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (l *rulesLinter) warn(line int, format string, args ...interface{}) {
+	l.issues = append(l.issues, &LintIssue{File: l.file, Line: line, Msg: fmt.Sprintf(format, args...), Warning: true})
+}
+
+func (l *rulesLinter) lineAt(offset int64) int {
+	return 1 + bytes.Count(l.data[:offset], []byte{'\n'})
+}
+
+// lintRules checks the rules file and returns the issues found in it,
+// the error is returned only if the file can't be read or parsed.
+func lintRules(file string) ([]*LintIssue, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	l := &rulesLinter{
+		file:     file,
+		data:     data,
+		locs:     make(map[string][]*ruleLoc),
+		sections: make(map[string]int),
+	}
+	if err = l.scanElements(); err != nil {
+		return nil, err
+	}
+	var rules ReRules
+	if err = xml.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for j, rr := range [][]ReRule{rules.Html, rules.Js, rules.Json, rules.Css} {
+		section := [...]string{"Html", "Js", "Json", "Css"}[j]
+		l.lintSection(section, rr)
+	}
+	if err = arrangeRules(&rules, nil); err != nil {
+		l.report(l.sections["ReRules"], "%v", err)
+	}
+	return l.issues, nil
+}
+
+// scanElements walks the raw xml to report unknown elements and attributes
+// and to record the line numbers of the rules.
+func (l *rulesLinter) scanElements() error {
+	var d = xml.NewDecoder(bytes.NewReader(l.data))
+	var stack []string
+	var current *ruleLoc
+	for {
+		offset := d.InputOffset()
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name, line := t.Name.Local, l.lineAt(offset)
+			attrs, known := lintSchema[name]
+			switch {
+			case lintUnused[name]:
+				l.warn(line, "element <%s> is not used", name)
+			case !known:
+				l.warn(line, "unknown element <%s>", name)
+			}
+			for _, a := range t.Attr {
+				if known && !containsString(attrs, a.Name.Local) {
+					l.warn(line, "unknown attribute %s of <%s>", a.Name.Local, name)
+				}
+			}
+			switch {
+			case name == "ReRule" && len(stack) > 0:
+				section := stack[len(stack)-1]
+				current = &ruleLoc{line: line, elems: make(map[string]int)}
+				l.locs[section] = append(l.locs[section], current)
+			case current != nil:
+				current.elems[name] = line
+			default:
+				l.sections[name] = line
+			}
+			stack = append(stack, name)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+			if t.Name.Local == "ReRule" {
+				current = nil
+			}
+		}
+	}
+}
+
+func (l *rulesLinter) lintSection(section string, rules []ReRule) {
+	locs := l.locs[section]
+	for i := range rules {
+		ru := &rules[i]
+		loc := &ruleLoc{line: l.sections[section], elems: map[string]int{}}
+		if i < len(locs) {
+			loc = locs[i]
+		}
+		at := func(elem string) int {
+			if line, y := loc.elems[elem]; y {
+				return line
+			}
+			return loc.line
+		}
+
+		scheme, err := parseScheme(ru.SchemeExpr)
+		if ru.SchemeExpr == NULL {
+			scheme = 0xff
+		}
+		if err != nil {
+			l.report(at("SchemeExpr"), "%v", err)
+		}
+		if scheme&0xff00 > 0 && strings.TrimSpace(ru.InsertHeader) == NULL {
+			l.warn(at("SchemeExpr"), "insert scheme without InsertHeader")
+		}
+		if scheme&0xff00 == 0 && strings.TrimSpace(ru.InsertHeader) != NULL {
+			l.warn(at("InsertHeader"), "InsertHeader is not used without insert scheme")
+		}
+
+		if ru.PathPattern != nil {
+			l.lintPattern(at("PathPattern"), ru.PathPattern)
+			if msg := pathNeverMatches(strings.TrimSpace(ru.PathPattern.Pattern)); msg != NULL {
+				l.warn(at("PathPattern"), "PathPattern never matches: %s", msg)
+			}
+		}
+		if ru.ContentPattern == nil || strings.TrimSpace(ru.ContentPattern.Pattern) == NULL {
+			l.warn(loc.line, "rule without ContentPattern")
+			continue
+		}
+		re := l.lintPattern(at("ContentPattern"), ru.ContentPattern)
+		if re == nil {
+			continue
+		}
+		if scheme&0xff > 0 {
+			for _, msg := range lintReplacement(re, ru.Replacement) {
+				l.warn(at("Replacement"), "Replacement %s", msg)
+			}
+		}
+		for j := range rules {
+			if !appliedBefore(rules, j, i) || !shadowedBy(ru, &rules[j]) {
+				continue
+			}
+			if j < len(locs) {
+				l.warn(at("ContentPattern"), "shadowed by the global rule at line %d", locs[j].line)
+			} else {
+				l.warn(at("ContentPattern"), "shadowed by the global rule %d of <%s>", j, section)
+			}
+		}
+	}
+}
+
+func (l *rulesLinter) lintPattern(line int, rd *RegexpDescr) *regexp.Regexp {
+	for _, flag := range rd.Flags {
+		if flag != 'g' {
+			l.warn(line, "unknown flag %q", flag)
+		}
+	}
+	expr := strings.TrimSpace(rd.Pattern)
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		l.report(line, "%v", err)
+		return nil
+	}
+	tree, _ := syntax.Parse(expr, syntax.Perl)
+	if lead := leadingRepeat(tree); lead != nil {
+		var op = "*"
+		switch lead.Op {
+		case syntax.OpPlus:
+			op = "+"
+		case syntax.OpRepeat:
+			op = fmt.Sprintf("{%d,}", lead.Min)
+		}
+		l.warn(line, "leading .%s scans the rest of the text at every position", op)
+	}
+	walkRepeats(tree, false, func(sub *syntax.Regexp, nested bool) {
+		if nested {
+			l.warn(line, "nested unbounded repetition %s", sub)
+		} else if sub.Op == syntax.OpRepeat && sub.Max > 100 {
+			l.warn(line, "large counted repetition %s", sub)
+		}
+	})
+	return re
+}
+
+func isRepeat(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus, syntax.OpRepeat:
+		return true
+	}
+	return false
+}
+
+func isUnbounded(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpStar || re.Op == syntax.OpPlus || (re.Op == syntax.OpRepeat && re.Max < 0)
+}
+
+// leadingRepeat returns the .* or .+ the unanchored pattern starts with
+func leadingRepeat(re *syntax.Regexp) *syntax.Regexp {
+	for re.Op == syntax.OpConcat || re.Op == syntax.OpCapture {
+		if len(re.Sub) == 0 {
+			return nil
+		}
+		re = re.Sub[0]
+	}
+	if isUnbounded(re) {
+		switch re.Sub[0].Op {
+		case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+			return re
+		}
+	}
+	return nil
+}
+
+func walkRepeats(re *syntax.Regexp, inside bool, fn func(sub *syntax.Regexp, nested bool)) {
+	if isRepeat(re) {
+		unbounded := isUnbounded(re)
+		fn(re, inside && unbounded)
+		inside = inside || unbounded
+	}
+	for _, sub := range re.Sub {
+		walkRepeats(sub, inside, fn)
+	}
+}
+
+// pathNeverMatches tells why the pattern can't match any URL.Path
+func pathNeverMatches(expr string) string {
+	tree, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return NULL
+	}
+	tree = tree.Simplify()
+	if tree.Op == syntax.OpNoMatch {
+		return "empty language"
+	}
+	var elems = []*syntax.Regexp{tree}
+	if tree.Op == syntax.OpConcat {
+		elems = tree.Sub
+	}
+	for _, e := range elems {
+		if e.Op == syntax.OpLiteral && strings.ContainsRune(string(e.Rune), '?') {
+			return "the path never contains '?', the query is not a part of it"
+		}
+	}
+	if len(elems) > 1 && elems[0].Op == syntax.OpBeginText {
+		first := elems[1]
+		switch first.Op {
+		case syntax.OpLiteral:
+			if first.Rune[0] != '/' {
+				return "the path always starts with '/'"
+			}
+		case syntax.OpCharClass:
+			if !classContains(first.Rune, '/') {
+				return "the path always starts with '/'"
+			}
+		}
+	}
+	return NULL
+}
+
+func classContains(class []rune, r rune) bool {
+	for i := 0; i+1 < len(class); i += 2 {
+		if class[i] <= r && r <= class[i+1] {
+			return true
+		}
+	}
+	return false
+}
+
+// lintReplacement finds the references to non-existent groups
+func lintReplacement(re *regexp.Regexp, repl []byte) (msgs []string) {
+	if _, err := compileReplacement(re, repl); err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	template := string(repl)
+	for {
+		i := strings.IndexByte(template, '$')
+		if i < 0 || i+1 >= len(template) {
+			return
+		}
+		template = template[i+1:]
+		if template[0] == '$' {
+			template = template[1:]
+			continue
+		}
+		var name string
+		if template[0] == '{' {
+			end := strings.IndexByte(template, '}')
+			if end < 0 {
+				return
+			}
+			name, template = template[1:end], template[end+1:]
+			if strings.IndexByte(name, ':') >= 0 {
+				// function call, checked by compileReplacement
+				continue
+			}
+		} else {
+			end := 0
+			for end < len(template) && isGroupNameChar(template[end]) {
+				end++
+			}
+			name, template = template[:end], template[end:]
+		}
+		if name == NULL {
+			continue
+		}
+		if groupIndex(re, name) < 0 {
+			msg := fmt.Sprintf("refers to non-existent group %q", name)
+			if n := len(name) - len(strings.TrimLeft(name, "0123456789")); n > 0 && n < len(name) {
+				msg += fmt.Sprintf(", use ${%s}%s", name[:n], name[n:])
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+}
+
+func isGroupNameChar(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// appliedBefore reports whether the rule j runs before the rule i, in the
+// order of arrangeRules: higher priority first, then file order.
+func appliedBefore(rules []ReRule, j, i int) bool {
+	pj, pi := rules[j].Priority, rules[i].Priority
+	return pj > pi || pj == pi && j < i
+}
+
+// shadowedBy reports whether an earlier global rule removes everything
+// the rule could match.
+func shadowedBy(ru, prev *ReRule) bool {
+	if prev.PathPattern != nil || prev.ContentPattern == nil || !strings.ContainsRune(prev.ContentPattern.Flags, 'g') {
+		return false
+	}
+	if scheme, err := parseScheme(prev.SchemeExpr); err != nil || (prev.SchemeExpr != NULL && scheme&0xff == 0) {
+		return false
+	}
+	pattern := strings.TrimSpace(ru.ContentPattern.Pattern)
+	prevPattern := strings.TrimSpace(prev.ContentPattern.Pattern)
+	if pattern == prevPattern {
+		return true
+	}
+	re, err1 := regexp.Compile(pattern)
+	prevRe, err2 := regexp.Compile(prevPattern)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	literal, complete := prevRe.LiteralPrefix()
+	prefix, _ := re.LiteralPrefix()
+	return complete && literal != NULL &&
+		strings.Contains(prefix, literal) && !bytes.Contains(prev.Replacement, []byte(literal))
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func runLintRules() int {
+	issues, err := lintRules("rules.xml")
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	for _, i := range issues {
+		fmt.Println(i)
+	}
+	if len(issues) > 0 {
+		fmt.Printf("%d issue(s) found\n", len(issues))
+		return 1
+	}
+	return 0
+}
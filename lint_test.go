@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const lintSample = `<?xml version="1.0" encoding="utf-8"?>
+<ReRules>
+  <Html>
+    <ReRule>
+      <ContentPattern flags="g">//www\.google\.com</ContentPattern>
+      <Replacement/>
+    </ReRule>
+    <ReRule name="a" bogus="1">
+      <PathPattern>^search</PathPattern>
+      <ContentPattern flags="gx" complex="true">//www\.google\.com/x</ContentPattern>
+      <Replacement>$1x</Replacement>
+    </ReRule>
+    <ReRule dependsOn="nope">
+      <PathPattern>/search\?q=</PathPattern>
+      <ContentPattern>.*(a+)*</ContentPattern>
+      <SchemeExpr>replace=some</SchemeExpr>
+      <InsertHeaderBak>x</InsertHeaderBak>
+    </ReRule>
+  </Html>
+</ReRules>
+`
+
+func TestLintRules(t *testing.T) {
+	file := filepath.Join(os.TempDir(), "ezgoo_lint_rules.xml")
+	if err := ioutil.WriteFile(file, []byte(lintSample), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+
+	issues, err := lintRules(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		line int
+		msg  string
+	}{
+		{8, "unknown attribute bogus"},
+		{9, "always starts with '/'"},
+		{10, "unknown attribute complex"},
+		{10, `unknown flag 'x'`},
+		{10, "shadowed by the global rule at line 4"},
+		{11, `non-existent group "1x", use ${1}x`},
+		{14, "never contains '?'"},
+		{15, "leading .*"},
+		{15, "nested unbounded repetition"},
+		{16, `unknown scheme value "some"`},
+		{17, "<InsertHeaderBak> is not used"},
+		{2, `depends on unknown rule [nope]`},
+	}
+	for _, e := range expected {
+		var found bool
+		for _, i := range issues {
+			if i.Line == e.line && strings.Contains(i.Msg, e.msg) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("missing issue line=%d %s", e.line, e.msg)
+		}
+	}
+	for _, i := range issues {
+		t.Log(i)
+	}
+}
+
+func TestLintShadowOrder(t *testing.T) {
+	var rule = func(priority int, flags string) ReRule {
+		return ReRule{Priority: priority, ContentPattern: &RegexpDescr{Flags: flags, Pattern: "//www.google.com"}}
+	}
+	var samples = []struct {
+		rules    []ReRule
+		shadowed int // index of the shadowed rule, -1 for none
+	}{
+		{[]ReRule{rule(0, "g"), rule(0, NULL)}, 1},
+		// the later rule of higher priority runs first
+		{[]ReRule{rule(0, "g"), rule(1, NULL)}, -1},
+		{[]ReRule{rule(0, NULL), rule(1, "g")}, 0},
+	}
+	for n, sa := range samples {
+		l := &rulesLinter{file: "x", locs: map[string][]*ruleLoc{"Html": {{line: 3}, {line: 7}}}}
+		l.lintSection("Html", sa.rules)
+		var expected []string
+		if sa.shadowed >= 0 {
+			expected = append(expected, "shadowed by the global rule at line")
+		}
+		var got []string
+		for _, i := range l.issues {
+			if strings.Contains(i.Msg, "shadowed") {
+				got = append(got, i.Msg)
+			}
+		}
+		if len(got) != len(expected) {
+			t.Errorf("sample %d: %v", n, got)
+		}
+	}
+}
+
+func TestLintShadowWithoutLines(t *testing.T) {
+	rules := []ReRule{
+		{ContentPattern: &RegexpDescr{Flags: "g", Pattern: "//www.google.com"}},
+		{ContentPattern: &RegexpDescr{Pattern: "//www.google.com"}},
+	}
+	// fewer scanned positions than rules must not panic
+	l := &rulesLinter{file: "x", locs: map[string][]*ruleLoc{}, sections: map[string]int{"Html": 2}}
+	l.lintSection("Html", rules)
+	if len(l.issues) != 1 || l.issues[0].Msg != "shadowed by the global rule 0 of <Html>" {
+		t.Errorf("issues=%v", l.issues)
+	}
+}
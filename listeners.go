@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+const (
+	listenerPrefix = "Listener."
+	routesPrefix   = "Routes."
+)
+
+// listenerName returns the name of the listener of the section, the
+// legacy [HTTP.Server] and [HTTPS.Server] are the listeners http and https.
+func listenerName(section string) (string, bool) {
+	switch {
+	case section == "HTTP.Server":
+		return "http", true
+	case section == "HTTPS.Server":
+		return "https", true
+	case strings.HasPrefix(section, listenerPrefix) && len(section) > len(listenerPrefix):
+		return section[len(listenerPrefix):], true
+	}
+	return NULL, false
+}
+
+// initListeners reads the listener sections in file order, those without
+// Listen are disabled. A listener serves TLS if it has a certificate or ACME.
+func (c *AppConfig) initListeners(cfg *ini.File) error {
+	var servs []*AppServ
+	var names = make(map[string]bool)
+	for _, sec := range cfg.Sections() {
+		name, y := listenerName(sec.Name())
+		if !y {
+			continue
+		}
+		serv := &AppServ{
+			Name:              name,
+			section:           sec.Name(),
+			ForceHttps:        c.ForceHttps,
+			TrustProxy:        c.TrustProxy,
+			clientRestriction: c.clientRestrictions,
+		}
+		err := sec.MapTo(serv)
+		if err == nil {
+			err = sec.MapTo(&serv.clientRestriction)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", sec.Name(), err)
+		}
+		clearEmptyKeys(sec, &serv.clientRestriction)
+		if serv.Listen == NULL {
+			continue
+		}
+		if names[name] {
+			return fmt.Errorf("%s: duplicate listener %s", sec.Name(), name)
+		}
+		names[name] = true
+		var hasCert = serv.TlsCertificate != NULL || serv.TlsCertificateKey != NULL || len(trimList(serv.TlsCertificates)) > 0
+		if serv.ACME {
+			if hasCert {
+				return fmt.Errorf("%s: ACME listener with a certificate", sec.Name())
+			}
+			serv.tlType = TL_TLS
+		} else if sec.Name() == "HTTPS.Server" || hasCert {
+			serv.tlType = TL_TLS
+			if serv.certs, err = serv.loadCertificates(); err != nil {
+				return fmt.Errorf("%s: %v", sec.Name(), err)
+			}
+		}
+		serv.clientRestriction.init()
+		servs = append(servs, serv)
+	}
+	if len(servs) < 1 {
+		return fmt.Errorf("no listener was specified")
+	}
+	c.servers = servs
+	return nil
+}
+
+// loadCertificates loads TlsCertificate and TlsCertificates, the first
+// one is served to the clients without a matching SNI.
+func (s *AppServ) loadCertificates() (*CertStore, error) {
+	files, err := parseCertFiles(s.TlsCertificates)
+	if err != nil {
+		return nil, fmt.Errorf("TlsCertificates: %v", err)
+	}
+	if s.TlsCertificate != NULL || s.TlsCertificateKey != NULL || len(files) == 0 {
+		files = append([]certFiles{{s.TlsCertificate, s.TlsCertificateKey}}, files...)
+	}
+	return NewCertStore(s.Name, files)
+}
+
+// initProfiles loads the rules files and the routes sections chosen by
+// the site profiles of the listeners.
+func (c *AppConfig) initProfiles(cfg *ini.File) error {
+	var loaded = make(map[string]*ReRules)
+	for _, s := range c.servers {
+		if s.Rules != NULL {
+			if loaded[s.Rules] == nil {
+				rules, err := loadReRules(s.Rules, c.ruleGroups)
+				if err != nil {
+					return fmt.Errorf("%s: Rules %s: %v", s.section, s.Rules, err)
+				}
+				loaded[s.Rules] = rules
+			}
+			s.rules = loaded[s.Rules]
+		}
+		if s.Routes != NULL {
+			section := routesPrefix + s.Routes
+			if _, err := cfg.GetSection(section); err != nil {
+				return fmt.Errorf("%s: Routes: no section [%s]", s.section, section)
+			}
+			routes, err := initRoutes(cfg, section, c)
+			if err != nil {
+				return fmt.Errorf("%s: %v", section, err)
+			}
+			s.routes = routes
+		}
+	}
+	return nil
+}
+
+// ruleSet returns the rules of the site profile of the listener
+func (s *Session) ruleSet() *ReRules {
+	if s.serv != nil && s.serv.rules != nil {
+		return s.serv.rules
+	}
+	return reRules
+}
+
+// routeSet returns the routes of the site profile of the listener
+func (s *Session) routeSet() Routes {
+	if s.serv != nil && s.serv.routes != nil {
+		return s.serv.routes
+	}
+	return config.routes
+}
+
+// clearEmptyKeys zeroes the fields of v whose keys are empty in sec,
+// MapTo keeps the inherited values for them.
+func clearEmptyKeys(sec *ini.Section, v interface{}) {
+	for _, f := range iniFields(v) {
+		if containsString(sec.KeyStrings(), f.key) && sec.Key(f.key).String() == NULL {
+			f.value.Set(reflect.Zero(f.value.Type()))
+		}
+	}
+}
+
+// listenOverrides returns the Listen overrides of the -l flag, a comma-list
+// of name=address or of the addresses of the listener sections in order.
+func listenOverrides(cfg *ini.File, listen string) ([]configOverride, error) {
+	var sections = make(map[string]string)
+	var ordered []string
+	for _, sec := range cfg.Sections() {
+		if name, y := listenerName(sec.Name()); y {
+			sections[name] = sec.Name()
+			ordered = append(ordered, sec.Name())
+		}
+	}
+	var overrides []configOverride
+	for i, addr := range strings.Split(listen, ",") {
+		if addr = strings.TrimSpace(addr); addr == NULL {
+			continue
+		}
+		var section string
+		if kv := strings.SplitN(addr, "=", 2); len(kv) == 2 {
+			addr = kv[1]
+			if section = sections[kv[0]]; section == NULL {
+				section = listenerPrefix + kv[0]
+			}
+		} else if i < len(ordered) {
+			section = ordered[i]
+		} else {
+			return nil, fmt.Errorf("-l: no listener section for the address %s", addr)
+		}
+		overrides = append(overrides, configOverride{section, "Listen", addr, "-l"})
+	}
+	return overrides, nil
+}
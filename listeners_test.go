@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+const listenersSample = `
+[Basic]
+TrustProxy = false
+ForceHttps = true
+
+[ClientRestriction]
+UserAgent = Apple
+
+[Listener.internal]
+Listen = 127.0.0.1:8081
+TrustProxy = true
+ForceHttps = false
+UserAgent =
+Addresses = 10.0.0.0/8
+
+[Listener.public]
+Listen = :8080
+
+[Listener.off]
+Listen =
+
+[HTTP.Server]
+Listen = :8082
+`
+
+func TestListeners(t *testing.T) {
+	cfg, err := ini.Load([]byte(listenersSample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := new(AppConfig)
+	cfg.Section("Basic").MapTo(conf)
+	cfg.Section("ClientRestriction").MapTo(&conf.clientRestrictions)
+	if err = conf.initListeners(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.servers) != 3 {
+		t.Fatalf("listeners=%d", len(conf.servers))
+	}
+	internal, public, legacy := conf.servers[0], conf.servers[1], conf.servers[2]
+	if internal.Name != "internal" || !internal.TrustProxy || internal.ForceHttps || internal.clientRestriction.UserAgent != NULL {
+		t.Errorf("internal=%+v", internal)
+	}
+	if public.Name != "public" || public.TrustProxy || !public.ForceHttps || public.clientRestriction.UserAgent != "Apple" {
+		t.Errorf("public=%+v", public)
+	}
+	if legacy.Name != "http" || legacy.Listen != ":8082" || legacy.tlType != TL_PLAIN {
+		t.Errorf("legacy=%+v", legacy)
+	}
+
+	config = conf
+	req := httptest.NewRequest("GET", "/search", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	if s := NewSession(req, internal); s.aAddr != "192.0.2.1" || conf.CheckClientRestriction(s, req) {
+		t.Errorf("internal listener: addr=%s", s.aAddr)
+	}
+	req.Header.Del("X-Forwarded-For")
+	if s := NewSession(req, internal); !conf.CheckClientRestriction(s, req) {
+		t.Errorf("internal listener rejected the load balancer")
+	}
+	if s := NewSession(req, public); s.aAddr != req.RemoteAddr || conf.CheckClientRestriction(s, req) || !s.forceHttps() {
+		t.Errorf("public listener")
+	}
+
+	for _, bad := range []string{
+		"[Listener.a]\nListen = :1\n[Listener.b]\nListen = :2\n[HTTP.Server]\nListen = :3\n[Listener.http]\nListen = :4\n",
+		"[Listener.a]\nListen = :1\nTlsCertificate = missing.pem\n",
+		"[Listener.a]\nListen =\n",
+	} {
+		cfg, _ = ini.Load([]byte(bad))
+		if err = new(AppConfig).initListeners(cfg); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func TestListenOverrides(t *testing.T) {
+	cfg, _ := ini.Load([]byte(listenersSample))
+	overrides, err := listenOverrides(cfg, ":1,,:3, public2=:4,http=:5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][2]string{
+		{"Listener.internal", ":1"},
+		{"Listener.off", ":3"},
+		{"Listener.public2", ":4"},
+		{"HTTP.Server", ":5"},
+	}
+	if len(overrides) != len(expected) {
+		t.Fatalf("overrides=%v", overrides)
+	}
+	for i, o := range overrides {
+		if o.section != expected[i][0] || o.key != "Listen" || o.value != expected[i][1] {
+			t.Errorf("override %d: %+v", i, o)
+		}
+	}
+	if _, err = listenOverrides(cfg, ":1,:2,:3,:4,:5"); err == nil {
+		t.Errorf("address without listener accepted")
+	}
+}
+
+func TestListenerProfiles(t *testing.T) {
+	initTestConfig()
+	dir, err := ioutil.TempDir(NULL, "ezgoo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lite := filepath.Join(dir, "rules-lite.xml")
+	err = ioutil.WriteFile(lite, []byte(`<ReRules><Html><ReRule name="lite">
+<ContentPattern>x</ContentPattern><Replacement>y</Replacement>
+</ReRule></Html></ReRules>`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ini.Load([]byte(`
+[Listener.public]
+Listen = :8080
+
+[Listener.internal]
+Listen = :8081
+Rules = ` + lite + `
+Routes = internal
+
+[Routes]
+/about = status 200 public
+
+[Routes.internal]
+/about = status 200 internal
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := new(AppConfig)
+	if err = conf.initListeners(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if conf.routes, err = initRoutes(cfg, "Routes", conf); err != nil {
+		t.Fatal(err)
+	}
+	if err = conf.initProfiles(cfg); err != nil {
+		t.Fatal(err)
+	}
+	saved, savedRules := config, reRules
+	defer func() { config, reRules = saved, savedRules }()
+	config, reRules = conf, &ReRules{Html: []ReRule{{Name: "default"}}}
+
+	for i, body := range []string{"public\n", "internal\n"} {
+		req := httptest.NewRequest("GET", "/about", nil)
+		s := &Session{aMethod: "GET", url: req.URL, serv: conf.servers[i]}
+		w := httptest.NewRecorder()
+		if !s.serveRoute(w, req) || w.Body.String() != body {
+			t.Errorf("listener %s served %q", s.serv.Name, w.Body)
+		}
+		if rules := s.ruleSet(); (i == 1) != (rules.Html[0].Name == "lite") {
+			t.Errorf("listener %s rules %s", s.serv.Name, rules.Html[0].Name)
+		}
+	}
+
+	cfg.Section("Listener.internal").Key("Routes").SetValue("missing")
+	conf.initListeners(cfg)
+	if err = conf.initProfiles(cfg); err == nil || !strings.Contains(err.Error(), "[Routes.missing]") {
+		t.Errorf("err=%v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type MetricsConfig struct {
+	// path serving the counters as json, empty disables
+	Path string
+	// comma-list of CIDR allowed to read the metrics
+	Addresses []string
+	nets      []*net.IPNet
+}
+
+func defaultMetricsConfig() MetricsConfig {
+	return MetricsConfig{
+		Addresses: []string{"127.0.0.1/32", "::1/128"},
+	}
+}
+
+func (m *MetricsConfig) init() error {
+	for _, cidr := range trimList(m.Addresses) {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		m.nets = append(m.nets, n)
+	}
+	return nil
+}
+
+// metricsNames are the expvar maps of ezgoo, the others like cmdline
+// carrying the -set values are never served.
+var metricsNames []string
+
+func newMetricsMap(name string) *expvar.Map {
+	metricsNames = append(metricsNames, name)
+	return expvar.NewMap(name)
+}
+
+func (m *MetricsConfig) allowed(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	for _, n := range m.nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// metricsClient returns the address checked for the metrics, the socket
+// peer or behind a trusted proxy the last X-Forwarded-For entry, the one
+// appended by the proxy, the earlier entries could be forged.
+func (s *Session) metricsClient(req *http.Request) string {
+	xff := strings.Join(req.Header.Values("X-Forwarded-For"), ",")
+	if !s.trustProxy() || strings.TrimSpace(xff) == NULL {
+		return s.dAddr
+	}
+	return strings.TrimSpace(xff[strings.LastIndexByte(xff, ',')+1:])
+}
+
+// serveMetrics writes the expvar counters if the request is for the
+// metrics path.
+func (s *Session) serveMetrics(w http.ResponseWriter, req *http.Request) bool {
+	var conf = &config.metrics
+	if conf.Path == NULL || s.url.Path != conf.Path {
+		return false
+	}
+	if !conf.allowed(s.metricsClient(req)) {
+		outputError(w, errNotAllowed)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, "{\n")
+	for i, name := range metricsNames {
+		if i > 0 {
+			fmt.Fprint(w, ",\n")
+		}
+		fmt.Fprintf(w, "%q: %s", name, expvar.Get(name))
+	}
+	fmt.Fprint(w, "\n}\n")
+	return true
+}
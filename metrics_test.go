@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestServeMetrics(t *testing.T) {
+	config = new(AppConfig)
+	config.metrics = defaultMetricsConfig()
+	config.metrics.Path = "/metrics"
+	if err := config.metrics.init(); err != nil {
+		t.Fatal(err)
+	}
+	for addr, code := range map[string]int{"127.0.0.1:1234": 200, "[::1]:1234": 200, "10.0.0.1": 403} {
+		u, _ := url.Parse("/metrics")
+		// the forwarded address is never trusted
+		s := &Session{url: u, dAddr: addr, aAddr: "127.0.0.1"}
+		w := httptest.NewRecorder()
+		if !s.serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil)) || w.Code != code {
+			t.Errorf("addr=%s code=%d", addr, w.Code)
+		}
+		if code == 200 && (!strings.Contains(w.Body.String(), `"prefdom"`) || strings.Contains(w.Body.String(), `"cmdline"`)) {
+			t.Errorf("body=%s", w.Body)
+		}
+		if code == 200 {
+			var vars map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+				t.Errorf("invalid json %v", err)
+			}
+		}
+	}
+
+	// behind a trusted proxy the entry appended by the proxy is checked
+	for xff, code := range map[string]int{
+		"127.0.0.1":              200,
+		"203.0.113.5, 127.0.0.1": 200,
+		"203.0.113.5":            403,
+		"127.0.0.1, 203.0.113.5": 403,
+		"":                       200,
+	} {
+		u, _ := url.Parse("/metrics")
+		s := &Session{url: u, dAddr: "127.0.0.1:1234", serv: &AppServ{TrustProxy: true}}
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if xff != NULL {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		w := httptest.NewRecorder()
+		if s.serveMetrics(w, req); w.Code != code {
+			t.Errorf("xff=%s code=%d", xff, w.Code)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/Lafeng/ezgoo/glog"
+	"github.com/go-ini/ini"
+)
+
+// The config keys are taken in this order, the later one wins:
+//  1. the built-in defaults
+//  2. config.ini
+//  3. the environment, EZGOO_<SECTION>_<KEY>, e.g. EZGOO_LISTENER_HTTP_LISTEN
+//     for the Listen key of [Listener.http]
+//  4. the -set Section.Key=value flags, e.g. -set Listener.http.Listen=:80
+//  5. the -l flag for the listen addresses
+const envPrefix = "EZGOO_"
+
+// setFlags collects the repeated -set flags
+type setFlags []string
+
+func (f *setFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *setFlags) Set(v string) error {
+	if strings.IndexByte(v, '=') < 0 || strings.IndexByte(v[:strings.IndexByte(v, '=')], '.') < 0 {
+		return fmt.Errorf("expected Section.Key=value")
+	}
+	*f = append(*f, v)
+	return nil
+}
+
+var config_sets setFlags
+
+type configOverride struct {
+	section string
+	key     string
+	value   string
+	source  string // the environment variable or -set
+}
+
+// envName returns the environment variable of section.key, the chars
+// other than letters and digits are replaced with '_'.
+func envName(section, key string) string {
+	sanitize := func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}
+	return envPrefix + strings.Map(sanitize, section) + "_" + strings.Map(sanitize, key)
+}
+
+// splitSetName splits Section.Key at the longest section prefix known
+// by cfg or the schema, the last dot otherwise.
+func splitSetName(cfg *ini.File, name string) (section, key string) {
+	for i := strings.LastIndexByte(name, '.'); i > 0; i = strings.LastIndexByte(name[:i], '.') {
+		var prefix = name[:i]
+		if _, err := cfg.GetSection(prefix); err == nil {
+			return prefix, name[i+1:]
+		}
+		if _, y := listenerName(prefix); y {
+			return prefix, name[i+1:]
+		}
+		for _, sec := range configSchema {
+			if sec.name == prefix {
+				return prefix, name[i+1:]
+			}
+		}
+	}
+	i := strings.LastIndexByte(name, '.')
+	return name[:i], name[i+1:]
+}
+
+// configOverrides returns the overrides of environ, sets and the -l flag
+// in the order of precedence, and the EZGOO_ variables not matching any key.
+func configOverrides(cfg *ini.File, environ, sets []string, listen string) (overrides []configOverride, unknown []string, err error) {
+	// the keys of the schema and of the file
+	var names = make(map[string][2]string)
+	for _, sec := range configSchema {
+		if sec.name == "Listener" {
+			continue
+		}
+		for _, f := range sec.keys() {
+			names[envName(sec.name, f.key)] = [2]string{sec.name, f.key}
+		}
+	}
+	for _, sec := range cfg.Sections() {
+		var keys = sec.KeyStrings()
+		if schema := lookupSection(sec.Name()); schema != nil {
+			for _, f := range schema.keys() {
+				keys = append(keys, f.key)
+			}
+		}
+		for _, key := range keys {
+			names[envName(sec.Name(), key)] = [2]string{sec.Name(), key}
+		}
+	}
+	for _, kv := range environ {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 || !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		if name, y := names[kv[:i]]; y {
+			overrides = append(overrides, configOverride{name[0], name[1], kv[i+1:], kv[:i]})
+		} else {
+			unknown = append(unknown, kv[:i])
+		}
+	}
+	for _, kv := range sets {
+		i := strings.IndexByte(kv, '=')
+		section, key := splitSetName(cfg, strings.TrimSpace(kv[:i]))
+		overrides = append(overrides, configOverride{section, key, strings.TrimSpace(kv[i+1:]), "-set " + section + "." + key})
+	}
+	listens, err := listenOverrides(cfg, listen)
+	return append(overrides, listens...), unknown, err
+}
+
+func applyOverrides(cfg *ini.File, overrides []configOverride) error {
+	for _, o := range overrides {
+		sec, err := cfg.NewSection(o.section)
+		if err == nil {
+			// NewKey doesn't touch the key inherited from the parent section
+			_, err = sec.NewKey(o.key, o.value)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s.%s: %v", o.source, o.section, o.key, err)
+		}
+		if log.V(2) {
+			log.Infof("Config %s.%s overridden by %s", o.section, o.key, o.source)
+		}
+	}
+	return nil
+}
+
+// loadConfigFile loads config.ini with the overrides of the environment
+// and the -set flags.
+func loadConfigFile() (*ini.File, error) {
+	cfg, err := ini.Load("config.ini")
+	if err != nil {
+		return nil, err
+	}
+	overrides, unknown, err := configOverrides(cfg, os.Environ(), config_sets, listen)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range unknown {
+		log.Warningf("Environment %s doesn't match any config key", name)
+	}
+	return cfg, applyOverrides(cfg, overrides)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+const overridesSample = `
+[Basic]
+TrustProxy = true
+
+[HTTP.Server]
+Listen = :8080
+
+[HeaderPolicy]
+Referer = translate
+
+[HeaderPolicy.static]
+Host = *.gstatic.com
+
+[RuleGroups]
+promo = true
+`
+
+func TestEnvName(t *testing.T) {
+	for name, env := range map[[2]string]string{
+		{"HTTP.Server", "Listen"}:            "EZGOO_HTTP_SERVER_LISTEN",
+		{"ClientRestriction", "Addresses"}:   "EZGOO_CLIENTRESTRICTION_ADDRESSES",
+		{"HeaderPolicy.client-data", "Host"}: "EZGOO_HEADERPOLICY_CLIENT_DATA_HOST",
+	} {
+		if e := envName(name[0], name[1]); e != env {
+			t.Errorf("%s.%s env=%s", name[0], name[1], e)
+		}
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	cfg, err := ini.Load([]byte(overridesSample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{
+		"PATH=/bin",
+		"EZGOO_BASIC_FORCEHTTPS=true",
+		"EZGOO_HTTP_SERVER_LISTEN=:9090",
+		"EZGOO_DOMAINRESTRICTION_SUFFIXES=.google.com,.gstatic.com",
+		"EZGOO_CLIENTRESTRICTION_USERAGENT=Firefox # not a comment",
+		"EZGOO_HEADERPOLICY_STATIC_REFERER=strip",
+		"EZGOO_RULEGROUPS_PROMO=false",
+		"EZGOO_BASIC_HOST=www",
+	}
+	var sets = setFlags{}
+	for _, v := range []string{"HTTP.Server.Listen=:80", "HeaderPolicy.RequestSet.X-Test = 1", "HTTPS.Server.Listen=:443"} {
+		if err = sets.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sets.Set("Listen=:80") == nil || sets.Set("HTTP.Server.Listen") == nil {
+		t.Errorf("malformed -set accepted")
+	}
+	overrides, unknown, err := configOverrides(cfg, environ, sets, NULL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unknown) != 1 || unknown[0] != "EZGOO_BASIC_HOST" {
+		t.Errorf("unknown=%v", unknown)
+	}
+	if err = applyOverrides(cfg, overrides); err != nil {
+		t.Fatal(err)
+	}
+
+	var conf = new(AppConfig)
+	cfg.Section("Basic").MapTo(conf)
+	cfg.Section("DomainRestriction").MapTo(&conf.domainRestrictions)
+	cfg.Section("ClientRestriction").MapTo(&conf.clientRestrictions)
+	var plain, secure AppServ
+	cfg.Section("HTTP.Server").MapTo(&plain)
+	cfg.Section("HTTPS.Server").MapTo(&secure)
+	if !conf.ForceHttps || !conf.TrustProxy || plain.Listen != ":80" || secure.Listen != ":443" {
+		t.Errorf("basic=%+v http=%+v https=%+v", conf, plain, secure)
+	}
+	if len(conf.domainRestrictions.Suffixes) != 2 || conf.clientRestrictions.UserAgent != "Firefox # not a comment" {
+		t.Errorf("restrictions %+v %+v", conf.domainRestrictions, conf.clientRestrictions)
+	}
+	if v := cfg.Section("RuleGroups").Key("promo").MustBool(true); v {
+		t.Errorf("rule group promo enabled")
+	}
+	if cfg.Section("HeaderPolicy").Key("Referer").String() != "translate" ||
+		cfg.Section("HeaderPolicy.static").Key("Referer").String() != "strip" {
+		t.Errorf("child section override leaked to the parent")
+	}
+	if cfg.Section("HeaderPolicy").Key("RequestSet.X-Test").String() != "1" {
+		t.Errorf("dynamic key not set")
+	}
+}
+
+func TestListenerOverrides(t *testing.T) {
+	cfg, err := ini.Load([]byte(`
+[Listener.http]
+Listen = :8080
+
+[Listener.admin]
+Listen = 127.0.0.1:8081
+UserAgent = Apple
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{"EZGOO_LISTENER_HTTP_LISTEN=:9090", "EZGOO_LISTENER_ADMIN_USERAGENT="}
+	sets := setFlags{"Listener.admin.Listen=127.0.0.1:9091", "Listener.extra.Listen=:9092"}
+	overrides, unknown, err := configOverrides(cfg, environ, sets, NULL)
+	if err != nil || len(unknown) > 0 {
+		t.Fatalf("unknown=%v err=%v", unknown, err)
+	}
+	if err = applyOverrides(cfg, overrides); err != nil {
+		t.Fatal(err)
+	}
+	conf := new(AppConfig)
+	if err = conf.initListeners(cfg); err != nil {
+		t.Fatal(err)
+	}
+	var listens = make(map[string]string)
+	for _, s := range conf.servers {
+		listens[s.Name] = s.Listen
+	}
+	if len(listens) != 3 || listens["http"] != ":9090" || listens["admin"] != "127.0.0.1:9091" || listens["extra"] != ":9092" {
+		t.Errorf("listens=%v", listens)
+	}
+	if ua := conf.servers[1].clientRestriction.UserAgent; ua != NULL {
+		t.Errorf("admin UserAgent=%q", ua)
+	}
+}
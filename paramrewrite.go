@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+type ParamRewriteConfig struct {
+	// query and form parameters whose proxy urls are translated to
+	// upstream, * means all
+	Params []string
+	params map[string]bool
+}
+
+func defaultParamRewriteConfig() ParamRewriteConfig {
+	return ParamRewriteConfig{
+		Params: []string{"continue", "prev", "q", "url", "imgurl", "imgrefurl", "image_url"},
+	}
+}
+
+func (p *ParamRewriteConfig) init() {
+	p.params = make(map[string]bool)
+	for _, k := range trimList(p.Params) {
+		p.params[k] = true
+	}
+}
+
+func (p *ParamRewriteConfig) selected(name string) bool {
+	return p.params[name] || p.params["*"]
+}
+
+// rewriteParams translates the absolute proxy urls in the values of the
+// selected parameters, the order and encoding of the others are kept.
+func (s *Session) rewriteParams(encoded string) string {
+	var conf = &config.paramRewrite
+	if encoded == NULL || len(conf.params) == 0 {
+		return encoded
+	}
+	var pairs = strings.Split(encoded, "&")
+	for i, kv := range pairs {
+		eq := strings.IndexByte(kv, '=')
+		if eq < 0 {
+			continue
+		}
+		k, err := url.QueryUnescape(kv[:eq])
+		if err != nil || !conf.selected(k) {
+			continue
+		}
+		v, err := url.QueryUnescape(kv[eq+1:])
+		if err != nil || !strings.Contains(v, "://") {
+			continue
+		}
+		if u := s.upstreamUrl(v); u != nil {
+			pairs[i] = kv[:eq+1] + url.QueryEscape(u.String())
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// rewriteForm rewrites the urlencoded body, nil if the body is not a
+// form or too large.
+func (s *Session) rewriteForm(contentType string, body io.Reader) (*bytes.Reader, error) {
+	if body == nil || len(config.paramRewrite.params) == 0 {
+		return nil, nil
+	}
+	if mt, _, _ := mime.ParseMediaType(contentType); mt != "application/x-www-form-urlencoded" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxAcceptedLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxAcceptedLength {
+		return nil, errTooLarge
+	}
+	return bytes.NewReader([]byte(s.rewriteParams(string(b)))), nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestRewriteParams(t *testing.T) {
+	initTestConfig()
+	config.paramRewrite = defaultParamRewriteConfig()
+	config.paramRewrite.init()
+	s := &Session{aProto: "https", aHost: "px.example"}
+	samples := [][2]string{
+		{
+			"continue=https%3A%2F%2Fpx.example%2Fsearch%3Fq%3Da&hl=en",
+			"continue=https%3A%2F%2Fwww.google.com%2Fsearch%3Fq%3Da&hl=en",
+		},
+		{
+			"imgurl=https://px.example/!ssl.gstatic.com/i.png&x=https://px.example/",
+			"imgurl=https%3A%2F%2Fssl.gstatic.com%2Fi.png&x=https://px.example/",
+		},
+		{"q=hello+world&prev=https://example.com/", "q=hello+world&prev=https://example.com/"},
+		{"q&continue=%zz", "q&continue=%zz"},
+	}
+	for _, sa := range samples {
+		if dst := s.rewriteParams(sa[0]); dst != sa[1] {
+			t.Errorf("src=%s\n   dst=%s\nexpect=%s", sa[0], dst, sa[1])
+		}
+	}
+
+	body, err := s.rewriteForm("application/x-www-form-urlencoded; charset=UTF-8", strings.NewReader(samples[0][0]))
+	if err != nil || body == nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(body); string(b) != samples[0][1] {
+		t.Errorf("form=%s", b)
+	}
+	if body, _ = s.rewriteForm("multipart/form-data", strings.NewReader("x")); body != nil {
+		t.Errorf("rewrote multipart body")
+	}
+	if _, err = s.rewriteForm("application/x-www-form-urlencoded", strings.NewReader(strings.Repeat("x", maxAcceptedLength+1))); err != errTooLarge {
+		t.Errorf("err=%v", err)
+	}
+}
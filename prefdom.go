@@ -1,11 +1,15 @@
 package main
 
 import (
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Lafeng/ezgoo/glog"
 )
@@ -15,74 +19,106 @@ var (
 	reSig  = regexp.MustCompile(`sig=[^&'"=]+`)
 )
 
+type PrefDomConfig struct {
+	// keep a pool of NID cookies of the US preference domain in background
+	Pool bool
+	Size int
+	// the cookies older than MaxAge or expiring within 2*Interval are refreshed
+	MaxAge   time.Duration
+	Interval time.Duration
+	// send a pool cookie upstream for the clients without NID
+	Inject bool
+}
+
+func defaultPrefDomConfig() PrefDomConfig {
+	return PrefDomConfig{
+		Size:     4,
+		MaxAge:   7 * 24 * time.Hour,
+		Interval: 10 * time.Minute,
+	}
+}
+
+var prefDomMetrics = newMetricsMap("prefdom")
+
 func (s *Session) avoidCountryRedirect(xReq *PxReq, w http.ResponseWriter) (err error) {
-	defer func() {
-		if e := recover(); e != nil {
-			dumpError(e)
-			switch e.(type) {
-			case error:
-				err = e.(error)
-			default:
-				err = fmt.Errorf("%v", e)
-			}
+	var nid *http.Cookie
+	if prefDomPool != nil {
+		nid = prefDomPool.Get("handed")
+	}
+	if nid == nil {
+		prefDomMetrics.Add("fallback", 1)
+		// remove client old cookies
+		xReq.header.Del("Cookie")
+		xReq.header.Del("Accept-Encoding")
+		nid, err = fetchPrefDomNID(xReq.header) // use client header
+		if err != nil {
+			return dumpError(err)
 		}
-	}()
-	setPrefDom(xReq, w, s.plainHost)
+	}
+	s.setPrefDom(nid, w)
 	return
 }
 
-func setPrefDom(xReq *PxReq, w http.ResponseWriter, host string) {
-	var req *http.Request
-	var resp *http.Response
-	var body string
-
-	// remove client old cookies
-	xReq.header.Del("Cookie")
-	xReq.header.Del("Accept-Encoding")
+// setPrefDom gives nid to the client and redirects it to the home
+func (s *Session) setPrefDom(nid *http.Cookie, w http.ResponseWriter) {
+	nid.HttpOnly = true
+	if cookieJar != nil {
+		u, _ := url.Parse(default_protocol + default_host + "/")
+		w.Header().Del("Set-Cookie")
+		s.storeCookies(u, []*http.Cookie{nid}, w.Header())
+	} else {
+		w.Header().Set("Set-Cookie", cookieString(nid, cookieScope(NULL), &s.plainHost, true))
+	}
+	w.Header().Set("Location", "/")
+	w.WriteHeader(302)
+}
 
+// fetchPrefDomNID obtains a NID cookie of the US preference domain
+func fetchPrefDomNID(header http.Header) (*http.Cookie, error) {
 	baseUrl := default_protocol + default_host
 	ncrUrl := baseUrl + "/?gfe_rd=cr&gws_rd=cr"
-	req, _ = http.NewRequest("GET", ncrUrl, nil)
-	req.Header = xReq.header // use client header
-	resp, body = httpCallEx(req, false)
+	req, _ := http.NewRequest("GET", ncrUrl, nil)
+	req.Header = header
+	resp, body, err := httpCallEx(req, false)
+	if err != nil {
+		return nil, err
+	}
 
-	matches := reSig.FindStringSubmatch(body)
-	if matches == nil {
-		log.Infoln(body)
-		panic("sig not found")
+	sig := reSig.FindString(body)
+	if sig == NULL {
+		if log.V(2) {
+			log.Infoln(body)
+		}
+		return nil, fmt.Errorf("sig not found")
 	}
 
-	sig := matches[0]
 	setprefUrl := fmt.Sprintf("%s/setprefdomain?prefdom=US&prev=%s&%s", baseUrl, url.QueryEscape(ncrUrl), sig)
 	req, _ = http.NewRequest("GET", setprefUrl, nil)
-	req.Header = xReq.header
+	req.Header = cloneHeader(header)
 
-	nid, nidFound := extractNID(resp.Cookies())
-	if nidFound {
-		req.Header.Set("Cookie", cookieString(nid, nil, false))
-	} // else panic ?
-	resp, _ = httpCallEx(req, true)
+	if nid, found := extractNID(resp.Cookies()); found {
+		req.Header.Set("Cookie", cookieString(nid, NULL, nil, false))
+	}
+	resp, _, err = httpCallEx(req, true)
+	if err != nil {
+		return nil, err
+	}
 
-	nid, nidFound = extractNID(resp.Cookies())
-	if !nidFound {
+	nid, found := extractNID(resp.Cookies())
+	if !found {
 		dumpHeader(fmt.Sprintf("resp[%s]->%s", resp.Status, req.URL), resp.Header)
-		panic("nid not found")
-	} else {
-		nid.HttpOnly = true
-		w.Header().Set("Set-Cookie", cookieString(nid, &host, true))
+		return nil, fmt.Errorf("nid not found")
 	}
-	w.Header().Set("Location", "/")
-	w.WriteHeader(302)
+	return nid, nil
 }
 
-func httpCallEx(req *http.Request, ignoreRd bool) (resp *http.Response, body string) {
-	var err error
+func httpCallEx(req *http.Request, ignoreRd bool) (resp *http.Response, body string, err error) {
 	resp, err = http_client.Do(req)
 	if err != nil {
-		if e, y := err.(*url.Error); y && e.Err == err30xRedirect && ignoreRd {
+		if isRedirectError(err) && ignoreRd {
 			err = nil
 		} else {
-			panic(err)
+			return
 		}
 	}
 
@@ -95,7 +131,7 @@ func httpCallEx(req *http.Request, ignoreRd bool) (resp *http.Response, body str
 	if !consumeError(&err) {
 		log.Warningln(err)
 	}
-	return
+	return resp, body, nil
 }
 
 func extractNID(cookies []*http.Cookie) (nid *http.Cookie, found bool) {
@@ -108,3 +144,164 @@ func extractNID(cookies []*http.Cookie) (nid *http.Cookie, found bool) {
 	}
 	return
 }
+
+type prefDomEntry struct {
+	nid      *http.Cookie
+	obtained time.Time
+}
+
+// PrefDomPool keeps valid NID cookies to be handed to the clients
+// redirected to a country domain, or injected into upstream requests.
+type PrefDomPool struct {
+	conf     *PrefDomConfig
+	mu       sync.Mutex
+	entries  []*prefDomEntry
+	next     int
+	stop     chan bool
+	fetch    func() (*http.Cookie, error)
+	validate func(*http.Cookie) bool
+}
+
+var prefDomPool *PrefDomPool
+
+func NewPrefDomPool(conf *PrefDomConfig) *PrefDomPool {
+	if conf.Size <= 0 {
+		conf.Size = 1
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = 10 * time.Minute
+	}
+	p := &PrefDomPool{
+		conf:     conf,
+		stop:     make(chan bool),
+		fetch:    fetchPoolNID,
+		validate: validateNID,
+	}
+	go p.maintain()
+	return p
+}
+
+func poolHeader() http.Header {
+	return http.Header{
+		"User-Agent":      {defaultPrivacyConfig().UserAgents[0]},
+		"Accept-Language": {"en-US,en;q=0.9"},
+	}
+}
+
+func fetchPoolNID() (*http.Cookie, error) {
+	return fetchPrefDomNID(poolHeader())
+}
+
+// validateNID checks that the home page is served without a country
+// redirection for nid.
+func validateNID(nid *http.Cookie) bool {
+	req, _ := http.NewRequest("GET", default_protocol+default_host+"/", nil)
+	req.Header = poolHeader()
+	req.Header.Set("Cookie", cookieString(nid, NULL, nil, false))
+	resp, err := http_client.Do(req)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if isRedirectError(err) {
+		loc, _ := resp.Location()
+		return loc != nil && loc.Host == default_host
+	}
+	return err == nil && resp.StatusCode == 200
+}
+
+func (p *PrefDomPool) maintain() {
+	p.refill(time.Now())
+	ticker := time.NewTicker(p.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.refill(now)
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *PrefDomPool) stale(e *prefDomEntry, now time.Time) bool {
+	if p.conf.MaxAge > 0 && now.Sub(e.obtained) > p.conf.MaxAge {
+		return true
+	}
+	return !e.nid.Expires.IsZero() && e.nid.Expires.Sub(now) < 2*p.conf.Interval
+}
+
+// refill drops the stale and invalid cookies and fetches new ones up to
+// the pool size, the upstream calls are made without holding the lock.
+func (p *PrefDomPool) refill(now time.Time) {
+	p.mu.Lock()
+	var entries = append([]*prefDomEntry(nil), p.entries...)
+	p.mu.Unlock()
+
+	var kept = entries[:0]
+	for _, e := range entries {
+		switch {
+		case p.stale(e, now):
+			prefDomMetrics.Add("expired", 1)
+		case !p.validate(e.nid):
+			prefDomMetrics.Add("invalid", 1)
+		default:
+			kept = append(kept, e)
+		}
+	}
+	for len(kept) < p.conf.Size {
+		nid, err := p.fetch()
+		if err != nil {
+			prefDomMetrics.Add("fetch_errors", 1)
+			log.Warningln("Fetch prefdom cookie", err)
+			break
+		}
+		prefDomMetrics.Add("fetched", 1)
+		kept = append(kept, &prefDomEntry{nid: nid, obtained: now})
+	}
+
+	p.mu.Lock()
+	p.entries = kept
+	p.mu.Unlock()
+	size := new(expvar.Int)
+	size.Set(int64(len(kept)))
+	prefDomMetrics.Set("size", size)
+	if log.V(2) {
+		log.Infof("Prefdom pool size=%d", len(kept))
+	}
+}
+
+// Get returns a copy of the next cookie of the pool, nil if it's empty.
+// use is the name of the counter.
+func (p *PrefDomPool) Get(use string) *http.Cookie {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.entries) == 0 {
+		prefDomMetrics.Add("misses", 1)
+		return nil
+	}
+	p.next = (p.next + 1) % len(p.entries)
+	nid := *p.entries[p.next].nid
+	prefDomMetrics.Add(use, 1)
+	return &nid
+}
+
+// inject appends a pool NID to the upstream cookies of dst if there is none.
+func (p *PrefDomPool) inject(dst *url.URL, cookies []string) []string {
+	if !domainMatch(canonicalHost(dst.Host), "google.com") {
+		return cookies
+	}
+	for _, ck := range cookies {
+		if strings.HasPrefix(ck, "NID=") {
+			return cookies
+		}
+	}
+	if nid := p.Get("injected"); nid != nil {
+		cookies = append(cookies, nid.Name+"="+nid.Value)
+	}
+	return cookies
+}
+
+func (p *PrefDomPool) Close() error {
+	close(p.stop)
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPrefDomPool(t *testing.T) {
+	var serial int
+	var invalid = make(map[string]bool)
+	conf := defaultPrefDomConfig()
+	conf.Size = 2
+	p := &PrefDomPool{
+		conf: &conf,
+		fetch: func() (*http.Cookie, error) {
+			serial++
+			return &http.Cookie{Name: "NID", Value: fmt.Sprint(serial)}, nil
+		},
+		validate: func(nid *http.Cookie) bool {
+			return !invalid[nid.Value]
+		},
+	}
+	if p.Get("handed") != nil {
+		t.Errorf("empty pool")
+	}
+	now := time.Now()
+	p.refill(now)
+	if len(p.entries) != 2 || p.Get("handed").Value == p.Get("handed").Value {
+		t.Fatalf("entries=%d", len(p.entries))
+	}
+
+	// 1 becomes invalid, 2 is kept, 3 is fetched
+	invalid["1"] = true
+	p.refill(now.Add(time.Hour))
+	if values := p.entries[0].nid.Value + p.entries[1].nid.Value; values != "23" {
+		t.Errorf("values=%s", values)
+	}
+	// all stale
+	p.refill(now.Add(conf.MaxAge + 2*time.Hour))
+	if values := p.entries[0].nid.Value + p.entries[1].nid.Value; values != "45" {
+		t.Errorf("values=%s", values)
+	}
+
+	p.fetch = func() (*http.Cookie, error) { return nil, fmt.Errorf("sig not found") }
+	p.refill(now.Add(3 * conf.MaxAge))
+	if len(p.entries) != 0 {
+		t.Errorf("stale entries kept")
+	}
+}
+
+func TestPrefDomInject(t *testing.T) {
+	p := &PrefDomPool{entries: []*prefDomEntry{{nid: &http.Cookie{Name: "NID", Value: "x"}}}}
+	samples := []struct {
+		host    string
+		cookies []string
+		n       int
+	}{
+		{"www.google.com", nil, 1},
+		{"www.google.com", []string{"NID=y"}, 1},
+		{"www.google.com", []string{"a=1"}, 2},
+		{"ssl.gstatic.com", nil, 0},
+	}
+	for _, sa := range samples {
+		cookies := p.inject(&url.URL{Host: sa.host}, sa.cookies)
+		if len(cookies) != sa.n {
+			t.Errorf("host=%s cookies=%v", sa.host, cookies)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type PrivacyConfig struct {
+	Enabled bool
+	// pools of User-Agent by tier separated by '|', a client gets a stable
+	// one of its tier, one entry makes a canonical UA
+	UserAgents       []string `delim:"|"`
+	MobileUserAgents []string `delim:"|"`
+	// fixed Accept-Language, empty means keeping the first language of
+	// the client only
+	AcceptLanguage   string
+	StripClientHints bool
+	// query parameters removed from the upstream urls
+	TrackingParams []string
+	trackingParams map[string]bool
+}
+
+func defaultPrivacyConfig() PrivacyConfig {
+	return PrivacyConfig{
+		UserAgents: []string{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+		},
+		MobileUserAgents: []string{
+			"Mozilla/5.0 (Linux; Android 10; K) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+		},
+		StripClientHints: true,
+		TrackingParams:   []string{"ei", "ved", "sa", "usg"},
+	}
+}
+
+func (p *PrivacyConfig) init() {
+	p.UserAgents = trimList(p.UserAgents)
+	p.MobileUserAgents = trimList(p.MobileUserAgents)
+	p.trackingParams = make(map[string]bool)
+	for _, k := range trimList(p.TrackingParams) {
+		p.trackingParams[k] = true
+	}
+}
+
+func trimList(list []string) []string {
+	var trimmed = make([]string, 0, len(list))
+	for _, v := range list {
+		if v = strings.TrimSpace(v); v != NULL {
+			trimmed = append(trimmed, v)
+		}
+	}
+	return trimmed
+}
+
+func isMobileAgent(ua string) bool {
+	return strings.Contains(ua, "Mobile") || strings.Contains(ua, "Android")
+}
+
+// userAgent picks the UA of the client tier, the same client UA always
+// gets the same one.
+func (p *PrivacyConfig) userAgent(clientUA string) string {
+	var pool = p.UserAgents
+	if isMobileAgent(clientUA) && len(p.MobileUserAgents) > 0 {
+		pool = p.MobileUserAgents
+	}
+	if len(pool) == 0 {
+		return clientUA
+	}
+	h := fnv.New32a()
+	h.Write([]byte(clientUA))
+	return pool[h.Sum32()%uint32(len(pool))]
+}
+
+// zh-CN,zh;q=0.9,en;q=0.8 -> zh-CN,zh;q=0.9
+func normalizeLanguage(al string) string {
+	first := strings.TrimSpace(strings.SplitN(al, ",", 2)[0])
+	if i := strings.IndexByte(first, ';'); i >= 0 {
+		first = strings.TrimSpace(first[:i])
+	}
+	if first == NULL || first == "*" {
+		return NULL
+	}
+	if i := strings.IndexByte(first, '-'); i > 0 {
+		return first + "," + first[:i] + ";q=0.9"
+	}
+	return first
+}
+
+// stripParams removes the tracking parameters from the raw query,
+// the order of the others is kept.
+func (p *PrivacyConfig) stripParams(rawQuery string) string {
+	if rawQuery == NULL || len(p.trackingParams) == 0 {
+		return rawQuery
+	}
+	var kept []string
+	for _, kv := range strings.Split(rawQuery, "&") {
+		k := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			k = kv[:i]
+		}
+		if k, err := url.QueryUnescape(k); err == nil && p.trackingParams[k] {
+			continue
+		}
+		kept = append(kept, kv)
+	}
+	return strings.Join(kept, "&")
+}
+
+// privatizeRequest normalizes the fingerprint of the upstream request.
+func (p *PrivacyConfig) privatizeRequest(dst *url.URL, h http.Header) {
+	if ua := h.Get("User-Agent"); ua != NULL {
+		h.Set("User-Agent", p.userAgent(ua))
+	}
+	if p.AcceptLanguage != NULL {
+		h.Set("Accept-Language", p.AcceptLanguage)
+	} else if al := normalizeLanguage(h.Get("Accept-Language")); al != NULL {
+		h.Set("Accept-Language", al)
+	} else {
+		h.Del("Accept-Language")
+	}
+	if p.StripClientHints {
+		for k := range h {
+			if strings.HasPrefix(k, "Sec-Ch-") {
+				delete(h, k)
+			}
+		}
+	}
+	dst.RawQuery = p.stripParams(dst.RawQuery)
+	if ref := h.Get("Referer"); ref != NULL {
+		if u, err := url.Parse(ref); err == nil {
+			u.RawQuery = p.stripParams(u.RawQuery)
+			h.Set("Referer", u.String())
+		}
+	}
+}
+
+// privatizeResponse stops the browser sending the client hints
+func (p *PrivacyConfig) privatizeResponse(h http.Header) {
+	if p.StripClientHints {
+		h.Del("Accept-Ch")
+		h.Del("Critical-Ch")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestPrivatizeRequest(t *testing.T) {
+	p := defaultPrivacyConfig()
+	p.UserAgents = append(p.UserAgents, "ua2")
+	p.init()
+	dst, _ := url.Parse("https://www.google.com/search?q=a&ei=x&sa=X&ved=1&hl=en&usg")
+	h := http.Header{
+		"User-Agent":         {"Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0"},
+		"Accept-Language":    {"zh-CN,zh;q=0.9,en;q=0.8"},
+		"Sec-Ch-Ua":          {"Chromium"},
+		"Sec-Ch-Ua-Platform": {"Linux"},
+		"Referer":            {"https://www.google.com/search?q=b&ved=2"},
+	}
+	p.privatizeRequest(dst, h)
+	ua := h.Get("User-Agent")
+	if ua != p.UserAgents[0] && ua != p.UserAgents[1] {
+		t.Errorf("ua=%s", ua)
+	}
+	if dst.RawQuery != "q=a&hl=en" || h.Get("Referer") != "https://www.google.com/search?q=b" {
+		t.Errorf("query=%s referer=%s", dst.RawQuery, h.Get("Referer"))
+	}
+	if h.Get("Accept-Language") != "zh-CN,zh;q=0.9" || h["Sec-Ch-Ua"] != nil || len(h) != 3 {
+		t.Errorf("header=%v", h)
+	}
+	if p.userAgent("Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0") != ua {
+		t.Errorf("ua is not stable")
+	}
+	if p.userAgent("Mozilla/5.0 (Linux; Android 14) Mobile Safari") != p.MobileUserAgents[0] {
+		t.Errorf("mobile ua")
+	}
+}
+
+func TestNormalizeLanguage(t *testing.T) {
+	samples := [][2]string{
+		{"zh-CN,zh;q=0.9,en;q=0.8", "zh-CN,zh;q=0.9"},
+		{"en;q=0.8,fr", "en"},
+		{"*", NULL},
+		{NULL, NULL},
+	}
+	for _, sa := range samples {
+		if al := normalizeLanguage(sa[0]); al != sa[1] {
+			t.Errorf("%s => %s expected %s", sa[0], al, sa[1])
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Lafeng/ezgoo/glog"
+)
+
+const (
+	redirectSameHost = "same-host"
+	redirectDomain   = "domain"
+)
+
+type RedirectConfig struct {
+	// follow the upstream redirects on the server
+	Follow bool
+	// same-host or domain (anywhere within DomainRestriction)
+	Scope   string
+	MaxHops int
+	// globs of the upstream paths whose redirects are followed,
+	// empty means all
+	Paths        []string
+	ExcludePaths []string
+}
+
+func defaultRedirectConfig() RedirectConfig {
+	return RedirectConfig{
+		Scope:   redirectSameHost,
+		MaxHops: 3,
+	}
+}
+
+func (r *RedirectConfig) verify() error {
+	switch r.Scope {
+	case redirectSameHost, redirectDomain:
+	default:
+		return fmt.Errorf("Redirect.Scope: unknown value %q", r.Scope)
+	}
+	r.Paths, r.ExcludePaths = trimList(r.Paths), trimList(r.ExcludePaths)
+	return nil
+}
+
+func isRedirectError(err error) bool {
+	e, y := err.(*url.Error)
+	return y && e.Err == err30xRedirect
+}
+
+// nextHop returns the url the redirect resp of req should be followed to
+// on the server, nil if the client should be redirected.
+func (r *RedirectConfig) nextHop(s *Session, req *http.Request, resp *http.Response) *url.URL {
+	if len(r.Paths) > 0 && !matchAny(r.Paths, req.URL.Path) || matchAny(r.ExcludePaths, req.URL.Path) {
+		return nil
+	}
+	switch resp.StatusCode {
+	case 301, 302, 303:
+	case 307, 308:
+		// the body can't be sent again
+		if req.Method != "GET" && req.Method != "HEAD" {
+			return nil
+		}
+	default:
+		return nil
+	}
+	loc, err := req.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || loc.Scheme != "https" && loc.Scheme != "http" {
+		return nil
+	}
+	if r.Scope == redirectSameHost && loc.Host != req.URL.Host || !config.CheckDomainRestriction(loc.Host) {
+		return nil
+	}
+	// blocks are left to the abuse detection
+	if strings.HasPrefix(loc.Path, "/sorry/") {
+		return nil
+	}
+	// pass-through cookies must reach the browser
+	if cookieJar == nil && len(resp.Header["Set-Cookie"]) > 0 {
+		return nil
+	}
+	return loc
+}
+
+// roundTrip sends req and follows the upstream redirects allowed by the
+// config, xReq.url is updated to the url of the returned response.
+// wHeader receives the session cookie if a jar session is created.
+func (s *Session) roundTrip(xReq *PxReq, req *http.Request, wHeader http.Header) (resp *http.Response, err error) {
+	var session = s.egressSession()
+	resp, err = http_client.Do(traceEgress(withEgressSession(req, session), &xReq.egress))
+	var conf = &config.redirect
+	for hops := 0; conf.Follow && isRedirectError(err) && hops < conf.MaxHops; hops++ {
+		next := conf.nextHop(s, req, resp)
+		if next == nil {
+			break
+		}
+		if cookieJar != nil {
+			s.storeCookies(req.URL, resp.Cookies(), wHeader)
+		}
+		resp.Body.Close()
+		if log.V(2) {
+			log.Infof("%s follow redirection %s -> %s", s.aAddr, req.URL, next)
+		}
+
+		var method = req.Method
+		var header = cloneHeader(req.Header)
+		if resp.StatusCode <= 303 && method != "HEAD" {
+			method = "GET"
+			header.Del("Content-Type")
+		}
+		if config.privacy.Enabled {
+			next.RawQuery = config.privacy.stripParams(next.RawQuery)
+		}
+		if s.jar != nil {
+			var cookies []string
+			for _, ck := range s.jar.Cookies(next) {
+				cookies = append(cookies, ck.String())
+			}
+			header.Del("Cookie")
+			if len(cookies) > 0 {
+				header.Set("Cookie", strings.Join(cookies, "; "))
+			}
+		} else if next.Host != req.URL.Host {
+			// the browser cookies belong to the origin host
+			header.Del("Cookie")
+		}
+		if next.Host != default_host {
+			xReq.nondefault |= 0xf
+		} else {
+			xReq.nondefault &^= 0xf
+		}
+		xReq.url = next
+		req, _ = NewRequest(method, next, nil)
+		req.Header = header
+		resp, err = http_client.Do(traceEgress(withEgressSession(req, session), &xReq.egress))
+	}
+	return
+}
+
+func cloneHeader(h http.Header) http.Header {
+	var h2 = make(http.Header, len(h))
+	for k, vv := range h {
+		h2[k] = append([]string(nil), vv...)
+	}
+	return h2
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRoundTripRedirect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/b", 302)
+	})
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "c?x=1", 301)
+	})
+	mux.HandleFunc("/c", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method))
+	})
+	mux.HandleFunc("/cookie", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "NID", Value: "1"})
+		http.Redirect(w, r, "/c", 302)
+	})
+	mux.HandleFunc("/away", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://example.com/", 302)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	config = new(AppConfig)
+	config.redirect = defaultRedirectConfig()
+	config.redirect.Follow = true
+	config.redirect.ExcludePaths = []string{"/b"}
+	config.redirect.verify()
+
+	samples := []struct {
+		path, final string
+		status      int
+	}{
+		{"/a", "/b", 301},
+		{"/cookie", "/cookie", 302},
+		{"/away", "/away", 302},
+	}
+	for _, sa := range samples {
+		u, _ := url.Parse(ts.URL + sa.path)
+		xReq := &PxReq{url: u, header: make(http.Header)}
+		req, _ := NewRequest("POST", u, nil)
+		resp, err := new(Session).roundTrip(xReq, req, make(http.Header))
+		if err != nil && !isRedirectError(err) {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != sa.status || xReq.url.Path != sa.final {
+			t.Errorf("path=%s status=%d final=%s", sa.path, resp.StatusCode, xReq.url)
+		}
+	}
+
+	config.redirect.ExcludePaths = nil
+	u, _ := url.Parse(ts.URL + "/a")
+	xReq := &PxReq{url: u, header: make(http.Header)}
+	req, _ := NewRequest("POST", u, nil)
+	resp, err := new(Session).roundTrip(xReq, req, make(http.Header))
+	if err != nil || resp.StatusCode != 200 || xReq.url.RequestURI() != "/c?x=1" {
+		t.Errorf("status=%v final=%s err=%v", resp.StatusCode, xReq.url, err)
+	}
+	resp.Body.Close()
+
+	config.redirect.MaxHops = 1
+	resp, err = new(Session).roundTrip(xReq, req, make(http.Header))
+	if !isRedirectError(err) || resp.StatusCode != 301 {
+		t.Errorf("status=%d hops were not bounded", resp.StatusCode)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/Lafeng/ezgoo/glog"
+)
+
+type RedirectorConfig struct {
+	// the target schemes redirected to
+	Schemes []string
+	// show a page with the destination instead of redirecting to the
+	// targets outside of the DomainRestriction
+	Interstitial bool
+	// send the targets within DomainRestriction to the proxy paths
+	Rewrite bool
+	// comma-list of host globs never redirected to
+	Blocklist []string
+	// file of more host globs, one per line
+	BlocklistFile string
+}
+
+func defaultRedirectorConfig() RedirectorConfig {
+	return RedirectorConfig{
+		Schemes:      []string{"http", "https"},
+		Interstitial: true,
+		Rewrite:      true,
+	}
+}
+
+func (c *RedirectorConfig) init() error {
+	c.Schemes = globList(c.Schemes)
+	c.Blocklist = globList(c.Blocklist)
+	if c.BlocklistFile == NULL {
+		return nil
+	}
+	file, err := os.Open(c.BlocklistFile)
+	if err != nil {
+		return fmt.Errorf("Redirector.BlocklistFile: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != NULL && line[0] != '#' {
+			c.Blocklist = append(c.Blocklist, strings.ToLower(line))
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *RedirectorConfig) blocked(host string) bool {
+	return matchAny(c.Blocklist, strings.ToLower(host))
+}
+
+const redirector_response = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="referrer" content="no-referrer">
+<meta name="robots" content="noindex"><title>Leaving</title></head>
+<body style="font-family:sans-serif;max-width:40em;margin:4em auto">
+<h2>You are leaving this site</h2>
+<p>The link leads to:</p>
+<p style="word-break:break-all"><code>%s</code></p>
+<p><a href="%s" rel="noreferrer noopener">Continue</a></p>
+</body></html>
+`
+
+// serveRedirector answers the /url redirector of the result links,
+// false lets the request be proxied if it has no target.
+func (s *Session) serveRedirector(w http.ResponseWriter, req *http.Request) bool {
+	var target = req.FormValue("url")
+	if target == NULL {
+		target = req.FormValue("q")
+	}
+	if target == NULL {
+		return false
+	}
+	var conf = &config.redirector
+	base, _ := url.Parse(default_protocol + default_host + "/")
+	u, err := base.Parse(target)
+	if err != nil || !matchAny(conf.Schemes, strings.ToLower(u.Scheme)) {
+		s.rejectRedirect(w, target, "scheme")
+		return true
+	}
+	// https:evil.example/x is opaque, the blocklist would see no host
+	if u.Host == NULL || u.Opaque != NULL {
+		s.rejectRedirect(w, target, "host")
+		return true
+	}
+	if strings.EqualFold(u.Host, s.aHost) {
+		// a proxy url already
+		u.Scheme, u.Host = NULL, NULL
+		http.Redirect(w, req, u.String(), 302)
+		return true
+	}
+	if conf.blocked(u.Hostname()) {
+		s.rejectRedirect(w, target, "blocklist")
+		return true
+	}
+	if conf.Rewrite {
+		if path, ok := proxyPath(u); ok {
+			http.Redirect(w, req, path, 302)
+			return true
+		}
+	}
+	h := w.Header()
+	h.Set("Referrer-Policy", "no-referrer")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Robots-Tag", "noindex")
+	if !conf.Interstitial {
+		http.Redirect(w, req, u.String(), 302)
+		return true
+	}
+	var dest = html.EscapeString(u.String())
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, redirector_response, dest, dest)
+	return true
+}
+
+func (s *Session) rejectRedirect(w http.ResponseWriter, target, reason string) {
+	if log.V(1) {
+		log.Warningf("%s redirector rejected %s: %q", s.aAddr, reason, target)
+	}
+	outputError(w, errNotAllowed)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedirector(t *testing.T) {
+	initTestConfig()
+	config.redirector = defaultRedirectorConfig()
+	config.redirector.Blocklist = []string{"*.evil.example", "evil.example"}
+	if err := config.redirector.init(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Session{aProto: "https", aHost: "px.example"}
+	samples := []struct {
+		target   string
+		status   int
+		location string
+	}{
+		{"https://scholar.google.com/x?y=1", 302, "/!scholar.google.com/x?y=1"},
+		{"/search?q=1", 302, "/search?q=1"},
+		{"https://px.example/!ssl.gstatic.com/a", 302, "/!ssl.gstatic.com/a"},
+		{"javascript:alert(1)", 403, NULL},
+		{"data:text/html,x", 403, NULL},
+		{"https://www.evil.example/", 403, NULL},
+		{"//EVIL.example/", 403, NULL},
+		{"https:evil.example/x", 403, NULL},
+		{"HTTPS:www.evil.example", 403, NULL},
+		{"http:/evil.example/", 403, NULL},
+		{"https:///evil.example/", 403, NULL},
+		{"https://example.com/<b>", 200, NULL},
+		{NULL, 0, NULL},
+	}
+	for _, sa := range samples {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/url?sa=t&url="+url.QueryEscape(sa.target), nil)
+		if served := s.serveRedirector(w, req); served != (sa.status != 0) {
+			t.Errorf("target=%s served=%v", sa.target, served)
+			continue
+		}
+		if sa.status != 0 && (w.Code != sa.status || w.Header().Get("Location") != sa.location) {
+			t.Errorf("target=%s status=%d location=%s", sa.target, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	// the interstitial shows the escaped destination
+	w := httptest.NewRecorder()
+	s.serveRedirector(w, httptest.NewRequest("GET", "/url?q="+url.QueryEscape("https://example.com/<b>"), nil))
+	body := w.Body.String()
+	if !strings.Contains(body, `href="https://example.com/%3Cb%3E"`) || strings.Contains(body, "<b>") {
+		t.Errorf("interstitial=%s", body)
+	}
+	if w.Header().Get("Referrer-Policy") != "no-referrer" {
+		t.Errorf("header=%v", w.Header())
+	}
+
+	config.redirector.Interstitial = false
+	config.redirector.Rewrite = false
+	for target, location := range map[string]string{
+		"https://example.com/a":   "https://example.com/a",
+		"https://www.google.com/": "https://www.google.com/",
+	} {
+		w = httptest.NewRecorder()
+		s.serveRedirector(w, httptest.NewRequest("GET", "/url?url="+url.QueryEscape(target), nil))
+		if w.Code != 302 || w.Header().Get("Location") != location {
+			t.Errorf("target=%s status=%d location=%s", target, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRedirectorBlocklistFile(t *testing.T) {
+	dir, err := ioutil.TempDir(NULL, "ezgoo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "blocklist.txt")
+	ioutil.WriteFile(file, []byte("# phishing\n*.Phish.example\n\nmalware.example\n"), 0644)
+	conf := defaultRedirectorConfig()
+	conf.Blocklist = []string{"evil.example"}
+	conf.BlocklistFile = file
+	if err = conf.init(); err != nil {
+		t.Fatal(err)
+	}
+	for host, blocked := range map[string]bool{
+		"evil.example":     true,
+		"a.phish.example":  true,
+		"MALWARE.example":  true,
+		"phish.example":    false,
+		"www.evil.example": false,
+		"www.google.com":   false,
+	} {
+		if conf.blocked(host) != blocked {
+			t.Errorf("host=%s blocked=%v", host, !blocked)
+		}
+	}
+	conf.BlocklistFile = filepath.Join(dir, "missing.txt")
+	if conf.init() == nil {
+		t.Errorf("missing blocklist file accepted")
+	}
+}
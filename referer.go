@@ -0,0 +1,24 @@
+package main
+
+const (
+	refererTranslate  = "translate"
+	refererStrip      = "strip"
+	refererOriginOnly = "origin-only"
+)
+
+// translateReferer returns the upstream Referer for the proxy referer ref
+// by policy, empty if it should not be sent. Foreign referers are never
+// forwarded.
+func (s *Session) translateReferer(ref, policy string) string {
+	if ref == NULL || policy == refererStrip {
+		return NULL
+	}
+	u := s.upstreamUrl(ref)
+	if u == nil {
+		return NULL
+	}
+	if policy == refererOriginOnly {
+		return u.Scheme + "://" + u.Host + "/"
+	}
+	return u.String()
+}
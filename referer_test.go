@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestTranslateReferer(t *testing.T) {
+	initTestConfig()
+	s := &Session{aProto: "https", aHost: "px.example"}
+	samples := []struct {
+		ref, policy, upstream string
+	}{
+		{"https://px.example/search?q=a", refererTranslate, "https://www.google.com/search?q=a"},
+		{"https://px.example/!ssl.gstatic.com/a/b", refererTranslate, "https://ssl.gstatic.com/a/b"},
+		{"https://px.example/!ssl.gstatic.com/a/b", refererOriginOnly, "https://ssl.gstatic.com/"},
+		{"https://px.example/search?q=a", refererStrip, NULL},
+		{"https://other.example/search?q=a", refererTranslate, NULL},
+		{"https://px.example/!example.com/", refererTranslate, NULL},
+	}
+	for _, sa := range samples {
+		if ref := s.translateReferer(sa.ref, sa.policy); ref != sa.upstream {
+			t.Errorf("ref=%s policy=%s upstream=%s", sa.ref, sa.policy, ref)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package regexp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	std "regexp"
+	"regexp/syntax"
+	"strings"
+	"testing"
+)
+
+const (
+	fuzzMaxPattern = 64
+	fuzzMaxInput   = 4 << 10
+	fuzzMaxProg    = 500
+)
+
+var fuzzSeeds = []struct {
+	pattern, src, repl string
+}{
+	{`.*`, "ajsldjfk", "0"},
+	{`(\w+)(,+)`, "asdf,,jkl;zxcv,,,mmm", "-$1"},
+	{`m+$`, "asdf,,jklm;zxcv,,,mmm", ""},
+	{`x*`, "abc", "-"},
+	{`\bab`, "ab cab ab", "${0}X"},
+	{`(?m)^\s*`, "a\n  b\n", ""},
+	{`(?i)é|É`, "éÉe", "E"},
+	{`onmousedown="[^\"]+?"`, `<a onmousedown="return rwt(this)" href="/url">`, `target="_blank"`},
+	{`(['\"])(?:[htps:]+)?//((?:en|id|ip|mt|kh)\w*\.google\.)`, `src="https://mt0.google.com/vt"`, `$1/!$2`},
+	{`\.src=([^)};]+)`, `a.src=b+"x";`, `.src=_DyRp($1)`},
+	{`^`, "", "head"},
+}
+
+// compilePair compiles the pattern with both implementations and reports
+// whether the pair is usable for a comparison.
+func compilePair(t *testing.T, pattern string) (*Regexp, *std.Regexp, bool) {
+	if len(pattern) > fuzzMaxPattern {
+		return nil, nil, false
+	}
+	// keep programs small, huge counted repetitions only slow the fuzzer down
+	if sx, err := syntax.Parse(pattern, syntax.Perl); err == nil {
+		if prog, err := syntax.Compile(sx.Simplify()); err == nil && len(prog.Inst) > fuzzMaxProg {
+			return nil, nil, false
+		}
+	}
+	sre, serr := std.Compile(pattern)
+	re, err := Compile(pattern)
+	if (serr == nil) != (err == nil) {
+		t.Fatalf("pa=%q compile mismatch: std=%v fork=%v", pattern, serr, err)
+	}
+	return re, sre, err == nil
+}
+
+func FuzzMatch(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(s.pattern, []byte(s.src))
+	}
+	f.Fuzz(func(t *testing.T, pattern string, src []byte) {
+		if len(src) > fuzzMaxInput {
+			return
+		}
+		re, sre, ok := compilePair(t, pattern)
+		if !ok {
+			return
+		}
+		ssrc := string(src)
+		check := func(api string, got, want interface{}) {
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("pa=%q src=%q %s:\n got=%v\nwant=%v", pattern, src, api, got, want)
+			}
+		}
+		check("NumSubexp", re.NumSubexp(), sre.NumSubexp())
+		check("SubexpNames", re.SubexpNames(), sre.SubexpNames())
+		// LiteralPrefix is not compared: newer std reports the prefix of
+		// anchored one-pass patterns too, e.g. "0" for `^0`.
+
+		check("Match", re.Match(src), sre.Match(src))
+		check("MatchString", re.MatchString(ssrc), sre.MatchString(ssrc))
+		check("MatchReader", re.MatchReader(strings.NewReader(ssrc)), sre.MatchReader(strings.NewReader(ssrc)))
+		check("Find", re.Find(src), sre.Find(src))
+		check("FindIndex", re.FindIndex(src), sre.FindIndex(src))
+		check("FindString", re.FindString(ssrc), sre.FindString(ssrc))
+		check("FindStringIndex", re.FindStringIndex(ssrc), sre.FindStringIndex(ssrc))
+		check("FindReaderIndex", re.FindReaderIndex(strings.NewReader(ssrc)), sre.FindReaderIndex(strings.NewReader(ssrc)))
+		check("FindSubmatch", re.FindSubmatch(src), sre.FindSubmatch(src))
+		check("FindSubmatchIndex", re.FindSubmatchIndex(src), sre.FindSubmatchIndex(src))
+		check("FindStringSubmatch", re.FindStringSubmatch(ssrc), sre.FindStringSubmatch(ssrc))
+		check("FindStringSubmatchIndex", re.FindStringSubmatchIndex(ssrc), sre.FindStringSubmatchIndex(ssrc))
+		check("FindReaderSubmatchIndex", re.FindReaderSubmatchIndex(strings.NewReader(ssrc)), sre.FindReaderSubmatchIndex(strings.NewReader(ssrc)))
+		check("FindAll", re.FindAll(src, -1), sre.FindAll(src, -1))
+		check("FindAllIndex", re.FindAllIndex(src, -1), sre.FindAllIndex(src, -1))
+		check("FindAllString", re.FindAllString(ssrc, -1), sre.FindAllString(ssrc, -1))
+		check("FindAllStringIndex", re.FindAllStringIndex(ssrc, 3), sre.FindAllStringIndex(ssrc, 3))
+		check("FindAllSubmatch", re.FindAllSubmatch(src, -1), sre.FindAllSubmatch(src, -1))
+		check("FindAllSubmatchIndex", re.FindAllSubmatchIndex(src, -1), sre.FindAllSubmatchIndex(src, -1))
+		check("FindAllStringSubmatch", re.FindAllStringSubmatch(ssrc, -1), sre.FindAllStringSubmatch(ssrc, -1))
+		check("FindAllStringSubmatchIndex", re.FindAllStringSubmatchIndex(ssrc, 2), sre.FindAllStringSubmatchIndex(ssrc, 2))
+		check("Split", re.Split(ssrc, -1), sre.Split(ssrc, -1))
+
+		re.Longest()
+		sre.Longest()
+		check("Longest.FindAllSubmatchIndex", re.FindAllSubmatchIndex(src, -1), sre.FindAllSubmatchIndex(src, -1))
+	})
+}
+
+func FuzzReplace(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(s.pattern, []byte(s.src), []byte(s.repl))
+	}
+	f.Fuzz(func(t *testing.T, pattern string, src, repl []byte) {
+		if len(src) > fuzzMaxInput || len(repl) > fuzzMaxPattern {
+			return
+		}
+		re, sre, ok := compilePair(t, pattern)
+		if !ok {
+			return
+		}
+		ssrc, srepl := string(src), string(repl)
+		check := func(api string, got, want interface{}) {
+			gb, ok1 := got.([]byte)
+			wb, ok2 := want.([]byte)
+			if ok1 && ok2 && bytes.Equal(gb, wb) {
+				return
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("pa=%q src=%q repl=%q %s:\n got=%q\nwant=%q", pattern, src, repl, api, got, want)
+			}
+		}
+		mark := func(b []byte) []byte { return []byte("<" + string(b) + ">") }
+
+		want := sre.ReplaceAll(src, repl)
+		check("ReplaceAll", re.ReplaceAll(src, repl), want)
+		check("ReplaceAllString", re.ReplaceAllString(ssrc, srepl), sre.ReplaceAllString(ssrc, srepl))
+		check("ReplaceAllLiteral", re.ReplaceAllLiteral(src, repl), sre.ReplaceAllLiteral(src, repl))
+		check("ReplaceAllLiteralString", re.ReplaceAllLiteralString(ssrc, srepl), sre.ReplaceAllLiteralString(ssrc, srepl))
+		check("ReplaceAllFunc", re.ReplaceAllFunc(src, mark), sre.ReplaceAllFunc(src, mark))
+		check("Expand", re.Expand(nil, repl, src, re.FindSubmatchIndex(src)), sre.Expand(nil, repl, src, sre.FindSubmatchIndex(src)))
+
+		// the count of ReplaceAll2 is the number of times std calls back
+		var cnt int
+		sre.ReplaceAllFunc(src, func(b []byte) []byte {
+			cnt++
+			return b
+		})
+		got, n := re.ReplaceAll2(src, repl)
+		check("ReplaceAll2", got, want)
+		check("ReplaceAll2.count", n, cnt)
+
+		once := src
+		if loc := sre.FindSubmatchIndex(src); loc != nil {
+			once = append([]byte(nil), src[:loc[0]]...)
+			once = sre.Expand(once, repl, src, loc)
+			once = append(once, src[loc[1]:]...)
+		}
+		check("ReplaceOnce", re.ReplaceOnce(src, repl), once)
+
+		// a lookahead covering the whole input makes streaming exact
+		var buf bytes.Buffer
+		n, err := re.ReplaceReader(&buf, bytes.NewReader(src), repl, -1, len(src)+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check("ReplaceReader", buf.Bytes(), want)
+		check("ReplaceReader.count", n, cnt)
+	})
+}
+
+var benchRules = []struct {
+	name, pattern, repl string
+}{
+	{"mousedown", `onmousedown="[^\"]+?"`, `target="_blank" rel="noreferrer"`},
+	{"static", `(?:[htps:]+)?//([-\w]+\.(?:gstatic|googleu|googlea))`, `/!$1`},
+	{"www", `(?:[htps:]+)?//www\.google\.com`, ``},
+	{"hosts", `(['\"])(?:[htps:]+)?//((?:en|id|ip|mt|kh)\w*\.google\.)`, `$1/!$2`},
+	{"promo", `pushdown_promo:`, `_:`},
+	{"imgsrc", `\.src=([^)};]+)`, `.src=_DyRp($1)`},
+	{"literal", `"(?:[htps:]+)?//([-.\w]+\.(?:google|gstatic))`, `"/!$1`},
+}
+
+func loadFixture(b *testing.B, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		b.Fatal(err)
+	}
+	// enlarge to the size of a typical response
+	return bytes.Repeat(data, (256<<10)/len(data)+1)
+}
+
+func benchmarkReplace(b *testing.B, fixture string) {
+	src := loadFixture(b, fixture)
+	for _, r := range benchRules {
+		re, repl := MustCompile(r.pattern), []byte(r.repl)
+		b.Run("ReplaceAll2/"+r.name, func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			for i := 0; i < b.N; i++ {
+				re.ReplaceAll2(src, repl)
+			}
+		})
+		b.Run("ReplaceOnce/"+r.name, func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			for i := 0; i < b.N; i++ {
+				re.ReplaceOnce(src, repl)
+			}
+		})
+		b.Run("ReplaceReader/"+r.name, func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			for i := 0; i < b.N; i++ {
+				re.ReplaceReader(ioutil.Discard, bytes.NewReader(src), repl, -1, 0)
+			}
+		})
+	}
+}
+
+func BenchmarkReplaceHtml(b *testing.B) {
+	benchmarkReplace(b, "search.html")
+}
+
+func BenchmarkReplaceJs(b *testing.B) {
+	benchmarkReplace(b, "xjs.js")
+}
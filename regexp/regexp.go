@@ -566,6 +566,12 @@ func (re *Regexp) ReplaceAll2(src, repl []byte) ([]byte, int) {
 }
 
 func (re *Regexp) ReplaceOnce(src, repl []byte) []byte {
+	dst, _ := re.ReplaceOnce2(src, repl)
+	return dst
+}
+
+// return.arg2: 1 if replaced, else 0
+func (re *Regexp) ReplaceOnce2(src, repl []byte) ([]byte, int) {
 	ma := re.FindSubmatchIndex(src)
 	if len(ma) > 0 { // found
 		dst := make([]byte, 0, len(src))
@@ -576,12 +582,39 @@ func (re *Regexp) ReplaceOnce(src, repl []byte) []byte {
 		if ePos := ma[1]; ePos < len(src) {
 			dst = append(dst, src[ePos:]...)
 		}
-		return dst
+		return dst, 1
 	} else { // not found
-		return src
+		return src, 0
 	}
 }
 
+// ReplaceAllSubmatchFunc returns a copy of src in which all matches of the
+// Regexp have been replaced by the bytes repl appends to dst. repl receives
+// the complete submatch index slice of the match within src.
+// return.arg2: the counter of replacing loop
+func (re *Regexp) ReplaceAllSubmatchFunc(src []byte, repl func(dst, src []byte, match []int) []byte) ([]byte, int) {
+	var i int
+	b := re.replaceAll(src, "", 2*(re.numSubexp+1), func(dst []byte, match []int) []byte {
+		i++
+		return repl(dst, src, re.pad(match))
+	})
+	return b, i
+}
+
+// ReplaceOnceSubmatchFunc is like ReplaceAllSubmatchFunc but replaces the
+// leftmost match only, as ReplaceOnce does.
+func (re *Regexp) ReplaceOnceSubmatchFunc(src []byte, repl func(dst, src []byte, match []int) []byte) ([]byte, int) {
+	ma := re.FindSubmatchIndex(src)
+	if len(ma) == 0 {
+		return src, 0
+	}
+	dst := make([]byte, 0, len(src))
+	dst = append(dst, src[:ma[0]]...)
+	dst = repl(dst, src, ma)
+	dst = append(dst, src[ma[1]:]...)
+	return dst, 1
+}
+
 // ReplaceAllLiteral returns a copy of src, replacing matches of the Regexp
 // with the replacement bytes repl.  The replacement repl is substituted directly,
 // without using Expand.
@@ -1,6 +1,7 @@
 package regexp
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -75,3 +76,24 @@ func TestReplaceOnce(t *testing.T) {
 		}
 	}
 }
+
+func TestReplaceSubmatchFunc(t *testing.T) {
+	re := MustCompile(`(\w+)(,+)`)
+	upper := func(dst, src []byte, match []int) []byte {
+		dst = append(dst, bytes.ToUpper(src[match[2]:match[3]])...)
+		return append(dst, byte('0'+match[5]-match[4]))
+	}
+	src := []byte("asdf,,jkl;zxcv,,,mmm")
+	dst, n := re.ReplaceAllSubmatchFunc(src, upper)
+	if n != 2 || string(dst) != "ASDF2jkl;ZXCV3mmm" {
+		t.Errorf("n=%d, dst=%s", n, dst)
+	}
+	dst, n = re.ReplaceOnceSubmatchFunc(src, upper)
+	if n != 1 || string(dst) != "ASDF2jkl;zxcv,,,mmm" {
+		t.Errorf("n=%d, dst=%s", n, dst)
+	}
+	dst, n = re.ReplaceOnceSubmatchFunc([]byte("kajsldkjflka"), upper)
+	if n != 0 || string(dst) != "kajsldkjflka" {
+		t.Errorf("n=%d, dst=%s", n, dst)
+	}
+}
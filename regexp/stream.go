@@ -0,0 +1,226 @@
+package regexp
+
+import (
+	"bytes"
+	"io"
+	"unicode/utf8"
+)
+
+// DefaultLookahead is the lookahead used by ReplaceWriter when a
+// non-positive lookahead is requested.
+const DefaultLookahead = 4 << 10
+
+// ReplaceWriter applies a replacement to the text written to it and
+// writes the result to an underlying io.Writer.
+//
+// The input is scanned through a bounded window: a match is only accepted
+// once at least lookahead bytes following its start have been seen, and
+// everything before the undecided tail of the window is flushed downstream.
+// The output is identical to ReplaceAll2 (or ReplaceOnce when the limit is 1)
+// over the whole input as long as no match, together with the text needed
+// to decide it, is longer than lookahead bytes. Anchors and word boundaries
+// are evaluated against the whole stream, not against individual writes.
+//
+// Close must be called to flush the remaining tail; it does not close the
+// underlying writer.
+type ReplaceWriter struct {
+	re        *Regexp
+	w         io.Writer
+	repl      string
+	ncap      int
+	limit     int // max replacements, <0 means unlimited
+	lookahead int
+	count     int
+	err       error
+
+	win          []byte // pending input, starting with a little history
+	out          []byte // replaced output waiting to be written
+	base         int    // offset of win[0] in the stream
+	searchPos    int    // position in win where we next look for a match
+	lastMatchEnd int    // end of the most recent match in win, may be negative
+	emitted      int    // win[:emitted] has been moved to out
+}
+
+// NewReplaceWriter returns a ReplaceWriter that replaces at most n matches
+// of re with the template repl and writes the result to w. If n < 0 all
+// matches are replaced. Inside repl, $ signs are interpreted as in Expand.
+// A non-positive lookahead selects DefaultLookahead.
+func (re *Regexp) NewReplaceWriter(w io.Writer, repl []byte, n, lookahead int) *ReplaceWriter {
+	if lookahead <= 0 {
+		lookahead = DefaultLookahead
+	}
+	ncap := 2
+	if bytes.IndexByte(repl, '$') >= 0 {
+		ncap = 2 * (re.numSubexp + 1)
+	}
+	return &ReplaceWriter{
+		re:        re,
+		w:         w,
+		repl:      string(repl),
+		ncap:      ncap,
+		limit:     n,
+		lookahead: lookahead,
+	}
+}
+
+// Count returns the number of replacements made so far.
+func (z *ReplaceWriter) Count() int {
+	return z.count
+}
+
+// Write buffers p and flushes every part of the input that can no longer
+// be affected by a future match.
+func (z *ReplaceWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if z.exhausted() {
+		z.flush()
+		if z.err == nil {
+			_, z.err = z.w.Write(p)
+		}
+		return len(p), z.err
+	}
+	z.win = append(z.win, p...)
+	// rescan only after a whole lookahead of fresh input has arrived,
+	// so that small writes do not cause quadratic scanning.
+	if len(z.win)-z.searchPos >= 2*z.lookahead {
+		z.process(false)
+		z.flush()
+	}
+	return len(p), z.err
+}
+
+// Close processes the remaining input as the end of the text and flushes
+// it to the underlying writer.
+func (z *ReplaceWriter) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+	z.process(true)
+	z.flush()
+	return z.err
+}
+
+func (z *ReplaceWriter) exhausted() bool {
+	return z.limit >= 0 && z.count >= z.limit
+}
+
+// process mirrors the loop of Regexp.replaceAll over the current window.
+// Unless final is set, it stops at the first match that starts within the
+// last lookahead bytes of the window.
+func (z *ReplaceWriter) process(final bool) {
+	re, win := z.re, z.win
+	end := len(win)
+	limit := end
+	if !final {
+		limit = z.alignBack(end - z.lookahead)
+	}
+	for z.searchPos <= end && !z.exhausted() {
+		if !final && z.searchPos >= limit {
+			break
+		}
+		a := re.doExecute(nil, win, "", z.searchPos, z.ncap)
+		if len(a) == 0 {
+			if !final {
+				z.skipTo(limit)
+			}
+			break
+		}
+		if !final && a[0] >= limit {
+			// the match may still change with more input
+			z.skipTo(limit)
+			break
+		}
+
+		z.out = append(z.out, win[z.emitted:a[0]]...)
+		// Skip an empty match immediately after another match,
+		// exactly as replaceAll does.
+		if a[1] > z.lastMatchEnd || z.base+a[0] == 0 {
+			z.out = re.expand(z.out, z.repl, win, "", a)
+			z.count++
+		}
+		z.lastMatchEnd = a[1]
+		z.emitted = a[1]
+
+		// Advance past this match; always advance at least one character.
+		_, width := utf8.DecodeRune(win[z.searchPos:])
+		if z.searchPos+width > a[1] {
+			z.searchPos += width
+		} else if z.searchPos+1 > a[1] {
+			// only at the end of the input
+			z.searchPos++
+		} else {
+			z.searchPos = a[1]
+		}
+	}
+	if final || z.exhausted() {
+		if z.emitted < end {
+			z.out = append(z.out, win[z.emitted:]...)
+		}
+		z.emitted = end
+		z.searchPos = end
+	}
+	z.trim()
+}
+
+// skipTo moves the search position forward to pos, which is known not to
+// be preceded by the start of any match, and releases the text before it.
+func (z *ReplaceWriter) skipTo(pos int) {
+	if pos > z.searchPos {
+		z.searchPos = pos
+	}
+	if z.searchPos > z.emitted {
+		z.out = append(z.out, z.win[z.emitted:z.searchPos]...)
+		z.emitted = z.searchPos
+	}
+}
+
+// alignBack moves pos back to the start of a rune, without going behind
+// the current search position.
+func (z *ReplaceWriter) alignBack(pos int) int {
+	for i := 0; i < utf8.UTFMax-1 && pos > z.searchPos && pos < len(z.win); i++ {
+		if utf8.RuneStart(z.win[pos]) {
+			break
+		}
+		pos--
+	}
+	return pos
+}
+
+// trim drops the flushed part of the window, keeping one rune of history
+// in front of the search position so that \b and ^ see the right context.
+func (z *ReplaceWriter) trim() {
+	drop := z.searchPos - utf8.UTFMax
+	if drop > z.emitted {
+		drop = z.emitted
+	}
+	if drop <= 0 {
+		return
+	}
+	n := copy(z.win, z.win[drop:])
+	z.win = z.win[:n]
+	z.base += drop
+	z.searchPos -= drop
+	z.emitted -= drop
+	z.lastMatchEnd -= drop
+}
+
+func (z *ReplaceWriter) flush() {
+	if len(z.out) > 0 && z.err == nil {
+		_, z.err = z.w.Write(z.out)
+	}
+	z.out = z.out[:0]
+}
+
+// ReplaceReader copies src to dst, replacing at most n matches of re with
+// the template repl (all matches if n < 0), and returns the number of
+// replacements made. See ReplaceWriter for the meaning of lookahead.
+func (re *Regexp) ReplaceReader(dst io.Writer, src io.Reader, repl []byte, n, lookahead int) (int, error) {
+	z := re.NewReplaceWriter(dst, repl, n, lookahead)
+	_, err := io.Copy(z, src)
+	if err == nil {
+		err = z.Close()
+	}
+	return z.count, err
+}
@@ -0,0 +1,105 @@
+package regexp
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+var streamPatterns = []struct {
+	pattern, repl string
+}{
+	{`a+b`, "<$0>"},
+	{`\bab`, "X"},
+	{`b\b`, "[$0]"},
+	{`^a`, "^"},
+	{`a$`, "$$"},
+	{`(?m)^c`, "C"},
+	{`(?m)b$`, "B"},
+	{`x*`, "-"},
+	{`(a|b)(c)?`, "$2$1"},
+	{`.{3}\n`, "|\n"},
+	{`é+`, "e"},
+	{`//www\.google\.com`, ""},
+	{`"//([-\w]+\.gstatic)`, `"/!$1`},
+}
+
+func randomText(r *rand.Rand, n int) []byte {
+	const alphabet = "aabbcx \n.é"
+	var pieces = []string{`"//www.google.com/x`, `"//ssl.gstatic.com/y`}
+	var buf bytes.Buffer
+	for buf.Len() < n {
+		if r.Intn(50) == 0 {
+			buf.WriteString(pieces[r.Intn(len(pieces))])
+			continue
+		}
+		runes := []rune(alphabet)
+		buf.WriteRune(runes[r.Intn(len(runes))])
+	}
+	return buf.Bytes()
+}
+
+func TestReplaceWriterRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, p := range streamPatterns {
+		re := MustCompile(p.pattern)
+		for round := 0; round < 50; round++ {
+			src := randomText(r, r.Intn(3000))
+			expected, cnt := re.ReplaceAll2(src, []byte(p.repl))
+
+			var dst bytes.Buffer
+			zw := re.NewReplaceWriter(&dst, []byte(p.repl), -1, 32+r.Intn(64))
+			for rest := src; len(rest) > 0; {
+				k := 1 + r.Intn(200)
+				if k > len(rest) {
+					k = len(rest)
+				}
+				zw.Write(rest[:k])
+				rest = rest[k:]
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(dst.Bytes(), expected) {
+				t.Fatalf("pa=%s src=%q\n got=%q\nwant=%q", p.pattern, src, dst.Bytes(), expected)
+			}
+			if zw.Count() != cnt {
+				t.Errorf("pa=%s count=%d want=%d", p.pattern, zw.Count(), cnt)
+			}
+		}
+	}
+}
+
+func TestReplaceReaderOnce(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for _, p := range streamPatterns {
+		re := MustCompile(p.pattern)
+		for round := 0; round < 20; round++ {
+			src := randomText(r, r.Intn(2000))
+			expected := re.ReplaceOnce(src, []byte(p.repl))
+
+			var dst bytes.Buffer
+			rd := iotest.OneByteReader(bytes.NewReader(src))
+			n, err := re.ReplaceReader(&dst, rd, []byte(p.repl), 1, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(dst.Bytes(), expected) {
+				t.Fatalf("pa=%s src=%q\n got=%q\nwant=%q", p.pattern, src, dst.Bytes(), expected)
+			}
+			if n > 1 || (n == 1) != re.Match(src) {
+				t.Errorf("pa=%s count=%d", p.pattern, n)
+			}
+		}
+	}
+}
+
+func TestReplaceReaderEmpty(t *testing.T) {
+	re := MustCompile(`^`)
+	var dst bytes.Buffer
+	n, err := re.ReplaceReader(&dst, bytes.NewReader(nil), []byte("head"), -1, 0)
+	if err != nil || n != 1 || dst.String() != "head" {
+		t.Errorf("n=%d dst=%s err=%v", n, dst.String(), err)
+	}
+}
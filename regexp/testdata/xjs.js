@@ -0,0 +1,9 @@
+try{
+var aa=this,ba=function(a){return void 0!==a},ca=function(){},da=function(a){a.Ub=function(){return a.nf?a.nf:a.nf=new a}},ea=function(a){var b=typeof a;if("object"==b)if(a){if(a instanceof Array)return"array";if(a instanceof Object)return b;var c=Object.prototype.toString.call(a);if("[object Window]"==c)return"object";if("[object Array]"==c||"number"==typeof a.length&&"undefined"!=typeof a.splice&&"undefined"!=typeof a.propertyIsEnumerable&&!a.propertyIsEnumerable("splice"))return"array"}else return"null";return b};
+var _jsl=function(a,b){var c=new Image;c.onerror=c.onload=c.onabort=function(){delete _jsl.lc[b]};_jsl.lc[b]=c;c.src=a+"&zx="+(new Date).getTime();},Ja=function(a){var b=document.createElement("script");b.src="https://www.google.com/xjs/_/js/k=xjs.s.zh_CN.HdK2z_Q2ZBo.O/m="+a+"/rt=j/d=0/t=zcms";document.body.appendChild(b)};
+var Ka="//ssl.gstatic.com/gb/js/sem_54d8de2d5e8c1c0dd5fdb6a9c03e7a09.js",La="https://apis.google.com/_/scs/abc-static/_/js/k=gapi.gapi.en.Y4N9C9cDdWs.O/m=gapi_iframes,googleapis_client",Ma="//clients1.google.com/complete/search",Na="//encrypted-tbn0.gstatic.com/images?q=tbn:";
+var Oa=function(a){a.style.background="url(//ssl.gstatic.com/ui/v1/button/search-white.png) no-repeat";a.src=Na+a.getAttribute("data-tbn")};
+_.Pa=function(a,b){this.j=a;this.o=b;this.A=new Image;this.A.src=a+(b?"?"+b:"")};_.Qa=function(a){var b=new Image;b.src=a;return b};
+google.sn="web";google.timers={};google.startTick=function(a,b){var c=b&&google.timers[b].t?google.timers[b].t.start:google.time();google.timers[a]={t:{start:c},e:{},it:{},m:{}};(c=window.performance)&&c.now&&(google.timers[a].wsrt=Math.floor(c.now()))};
+var Ra={"//www.google.com/imghp":"images","//maps.google.com/maps":"maps","//news.google.com/nwshp":"news","https://mail.google.com/mail":"gmail","//drive.google.com/":"drive","//kh.google.com/kh/v=690":"earth","//ipv4.google.com/sorry/IndexRedirect":"sorry"};
+}catch(e){_DumpException(e)}
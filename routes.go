@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+const (
+	routeStatus     = "status"
+	routeFile       = "file"
+	routeRedirect   = "redirect"
+	routeBlock      = "block"
+	routeProxy      = "proxy"
+	routeRedirector = "redirector"
+)
+
+// Route maps the request paths matching Path to an action:
+//
+//	status <code> [body]
+//	file <name> [content-type]   a file of the config dir
+//	redirect [code] <location>
+//	block
+//	proxy <upstream-host>
+//	redirector                   the /url redirector
+type Route struct {
+	Path   string
+	Action string
+	status int
+	arg    string
+	ctype  string
+}
+
+type Routes []*Route
+
+// the routes appended after the configured ones
+var builtinRoutes = Routes{
+	{Path: "/url", Action: routeRedirector},
+	{Path: "/setprefdomain", Action: routeRedirect, status: 301, arg: "/"},
+	{Path: "/robots.txt", Action: routeStatus, status: 200, arg: robots_response},
+}
+
+func parseRoute(conf *AppConfig, path, value string) (*Route, error) {
+	var f = strings.Fields(value)
+	if len(f) == 0 {
+		return nil, fmt.Errorf("route %s: no action", path)
+	}
+	var r = &Route{Path: path, Action: f[0]}
+	var err error
+	switch r.Action {
+	case routeStatus:
+		if len(f) < 2 {
+			break
+		}
+		r.status, err = strconv.Atoi(f[1])
+		if err == nil && (r.status < 100 || r.status > 599) {
+			err = fmt.Errorf("invalid status %d", r.status)
+		}
+		// the body keeps its inner spaces
+		body := strings.TrimSpace(strings.TrimSpace(value)[len(f[0]):])
+		r.arg = strings.TrimSpace(body[len(f[1]):])
+		if r.arg != NULL {
+			r.arg += "\n"
+		}
+		return r, routeError(path, err)
+	case routeFile:
+		if len(f) < 2 || len(f) > 3 {
+			break
+		}
+		r.arg = filepath.Clean(f[1])
+		if filepath.IsAbs(r.arg) || strings.HasPrefix(r.arg, "..") {
+			return nil, routeError(path, fmt.Errorf("file %s is outside of the config dir", f[1]))
+		}
+		if len(f) == 3 {
+			r.ctype = f[2]
+		}
+		return r, nil
+	case routeRedirect:
+		r.status = 302
+		switch len(f) {
+		case 2:
+			r.arg = f[1]
+		case 3:
+			r.status, err = strconv.Atoi(f[1])
+			if err == nil && (r.status < 300 || r.status > 399) {
+				err = fmt.Errorf("invalid redirect status %d", r.status)
+			}
+			r.arg = f[2]
+		default:
+			return nil, routeError(path, fmt.Errorf("redirect [code] <location> expected"))
+		}
+		return r, routeError(path, err)
+	case routeBlock, routeRedirector:
+		if len(f) == 1 {
+			return r, nil
+		}
+	case routeProxy:
+		if len(f) == 2 {
+			r.arg = strings.ToLower(f[1])
+			if !conf.CheckDomainRestriction(r.arg) {
+				return nil, routeError(path, fmt.Errorf("upstream %s is outside of the DomainRestriction", f[1]))
+			}
+			return r, nil
+		}
+	default:
+		return nil, routeError(path, fmt.Errorf("unknown action %q", r.Action))
+	}
+	return nil, routeError(path, fmt.Errorf("bad arguments %q", value))
+}
+
+func routeError(path string, err error) error {
+	if err != nil {
+		return fmt.Errorf("route %s: %v", path, err)
+	}
+	return nil
+}
+
+// initRoutes reads a routes section, the keys are path globs and
+// the first matching route is taken.
+func initRoutes(cfg *ini.File, section string, conf *AppConfig) (Routes, error) {
+	var routes Routes
+	for _, key := range cfg.Section(section).Keys() {
+		r, err := parseRoute(conf, key.Name(), key.Value())
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, r)
+	}
+	return append(routes, builtinRoutes...), nil
+}
+
+func (rs Routes) Select(path string) *Route {
+	for _, r := range rs {
+		if globMatch(r.Path, path) {
+			return r
+		}
+	}
+	return nil
+}
+
+// serveRoute answers the request by the matching route, false lets the
+// request be proxied.
+func (s *Session) serveRoute(w http.ResponseWriter, req *http.Request) bool {
+	r := s.routeSet().Select(s.url.Path)
+	if r == nil {
+		return false
+	}
+	switch r.Action {
+	case routeStatus:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(r.status)
+		if r.arg != NULL && s.aMethod != "HEAD" {
+			w.Write([]byte(r.arg))
+		}
+	case routeFile:
+		s.serveFile(w, req, r)
+	case routeRedirect:
+		http.Redirect(w, req, r.arg, r.status)
+	case routeBlock:
+		outputError(w, errNotAllowed)
+	case routeProxy:
+		if r.arg != default_host {
+			s.uri = "/!" + r.arg + s.uri
+		}
+		return false
+	case routeRedirector:
+		return s.serveRedirector(w, req)
+	}
+	return true
+}
+
+func (s *Session) serveFile(w http.ResponseWriter, req *http.Request, r *Route) {
+	file, err := os.Open(r.arg)
+	var fi os.FileInfo
+	if err == nil {
+		defer file.Close()
+		fi, err = file.Stat()
+	}
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, req)
+		return
+	}
+	if r.ctype != NULL {
+		w.Header().Set("Content-Type", r.ctype)
+	}
+	http.ServeContent(w, req, fi.Name(), fi.ModTime(), file)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+const routesSample = `
+[Routes]
+/gen_204 = status 204
+/teapot = status 418 short and stout
+/favicon.ico = file favicon.ico image/x-icon
+/landing = file landing.html
+/about = redirect 301 https://example.com/
+/go = redirect /search
+/admin/* = block
+/maps/* = proxy scholar.google.com
+/robots.txt = ` + "`status 200 User-agent: * # all`" + `
+`
+
+func TestRoutes(t *testing.T) {
+	initTestConfig()
+	cfg, err := ini.Load([]byte(routesSample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.routes, err = initRoutes(cfg, "Routes", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.redirector = defaultRedirectorConfig()
+
+	dir, err := ioutil.TempDir(NULL, "ezgoo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	ioutil.WriteFile("favicon.ico", []byte("icon"), 0644)
+
+	samples := []struct {
+		path     string
+		served   bool
+		status   int
+		header   string
+		body     string
+		proxyUri string
+	}{
+		{"/gen_204", true, 204, NULL, NULL, NULL},
+		{"/teapot", true, 418, NULL, "short and stout\n", NULL},
+		{"/favicon.ico", true, 200, "image/x-icon", "icon", NULL},
+		{"/landing", true, 404, NULL, NULL, NULL},
+		{"/about", true, 301, "https://example.com/", NULL, NULL},
+		{"/go", true, 302, "/search", NULL, NULL},
+		{"/admin/x", true, 403, NULL, NULL, NULL},
+		{"/maps/x?y=1", false, 0, NULL, NULL, "/!scholar.google.com/maps/x?y=1"},
+		{"/robots.txt", true, 200, NULL, "User-agent: * # all\n", NULL},
+		{"/setprefdomain", true, 301, "/", NULL, NULL},
+		{"/url?url=%2Fsearch", true, 302, "/search", NULL, NULL},
+		{"/url", false, 0, NULL, NULL, "/url"},
+		{"/search?q=1", false, 0, NULL, NULL, "/search?q=1"},
+	}
+	for _, sa := range samples {
+		req := httptest.NewRequest("GET", sa.path, nil)
+		s := &Session{aProto: "https", aHost: "px.example", aMethod: "GET", url: req.URL, uri: req.RequestURI}
+		w := httptest.NewRecorder()
+		if served := s.serveRoute(w, req); served != sa.served {
+			t.Errorf("path=%s served=%v", sa.path, served)
+			continue
+		}
+		if !sa.served {
+			if s.uri != sa.proxyUri {
+				t.Errorf("path=%s uri=%s", sa.path, s.uri)
+			}
+			continue
+		}
+		if w.Code != sa.status {
+			t.Errorf("path=%s status=%d", sa.path, w.Code)
+		}
+		if sa.header != NULL && w.Header().Get("Location") != sa.header && w.Header().Get("Content-Type") != sa.header {
+			t.Errorf("path=%s header=%v", sa.path, w.Header())
+		}
+		if sa.body != NULL && w.Body.String() != sa.body {
+			t.Errorf("path=%s body=%q", sa.path, w.Body.String())
+		}
+	}
+}
+
+func TestPreprocessRestriction(t *testing.T) {
+	initTestConfig()
+	cfg, err := ini.Load([]byte(routesSample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.routes, err = initRoutes(cfg, "Routes", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.clientRestrictions.UserAgent = "Apple"
+
+	samples := []struct {
+		method, path, ua string
+		status           int
+	}{
+		{"GET", "/gen_204", "curl", 403},
+		{"GET", "/gen_204", "AppleWebKit", 204},
+		{"OPTIONS", "/!ssl.gstatic.com/x", "curl", 403},
+		{"OPTIONS", "/!ssl.gstatic.com/x", "AppleWebKit", 204},
+		{"GET", "/robots.txt", "curl", 200},
+		{"HEAD", "/", "curl", 200},
+	}
+	for _, sa := range samples {
+		req := httptest.NewRequest(sa.method, "https://px.example"+sa.path, nil)
+		req.Header.Set("User-Agent", sa.ua)
+		if sa.method == "OPTIONS" {
+			req.Header.Set("Origin", "https://px.example")
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		s := &Session{aProto: "https", aHost: "px.example", aMethod: sa.method, url: req.URL, uri: req.URL.RequestURI()}
+		w := httptest.NewRecorder()
+		if !s.Preprocess(w, req) || w.Code != sa.status {
+			t.Errorf("%s %s ua=%s status=%d", sa.method, sa.path, sa.ua, w.Code)
+		}
+	}
+}
+
+func TestParseRouteErrors(t *testing.T) {
+	initTestConfig()
+	for _, value := range []string{
+		NULL,
+		"status",
+		"status 42",
+		"status ok",
+		"file ../config.ini",
+		"file /etc/passwd",
+		"redirect",
+		"redirect 200 /x",
+		"block now",
+		"proxy example.com",
+		"serve x",
+	} {
+		if _, err := parseRoute(config, "/x", value); err == nil {
+			t.Errorf("route %q accepted", value)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Lafeng/ezgoo/regexp"
+)
+
+const (
+	reportingDrop    = "drop"
+	reportingRewrite = "rewrite"
+)
+
+type SecurityHeaders struct {
+	// map the upstream sources of Content-Security-Policy to the proxy origin
+	RewriteCSP bool
+	// reporting endpoints of CSP, Report-To, Reporting-Endpoints and NEL:
+	// drop or rewrite to the proxy, the endpoints outside of the
+	// DomainRestriction are always dropped
+	Reporting string
+	// Strict-Transport-Security value, sent only if ForceHttps
+	HSTS               string
+	ContentTypeOptions string
+	PermissionsPolicy  string
+	// sources of the frame-ancestors directive, e.g. 'self'
+	FrameAncestors string
+}
+
+var reQuotedUrl = regexp.MustCompile(`"([^"]+)"`)
+
+func defaultSecurityHeaders() SecurityHeaders {
+	return SecurityHeaders{
+		RewriteCSP: true,
+		Reporting:  reportingDrop,
+	}
+}
+
+func (sh *SecurityHeaders) verify() error {
+	switch sh.Reporting {
+	case reportingDrop, reportingRewrite:
+		return nil
+	}
+	return fmt.Errorf("SecurityHeaders.Reporting: unknown value %q", sh.Reporting)
+}
+
+func (s *Session) proxyOrigin() string {
+	return s.aProto + "://" + s.aHost
+}
+
+// secureHeaders rewrites the upstream security headers of h and adds the
+// configured ones.
+func (s *Session) secureHeaders(h http.Header) {
+	var sh = &config.securityHeaders
+	var origin = s.proxyOrigin()
+	var keepReport = sh.Reporting == reportingRewrite
+	for _, k := range []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+		rewriteHeader(h, k, func(v string) string {
+			return rewriteCSP(v, origin, sh.RewriteCSP, keepReport)
+		})
+	}
+	if keepReport {
+		rewriteHeader(h, "Report-To", func(v string) string {
+			return rewriteReportTo(v, origin)
+		})
+		rewriteHeader(h, "Reporting-Endpoints", func(v string) string {
+			return rewriteReportingEndpoints(v, origin)
+		})
+	} else {
+		h.Del("Report-To")
+		h.Del("Reporting-Endpoints")
+		h.Del("Nel")
+	}
+
+	// upstream HSTS may include subdomains of the proxy
+	h.Del("Strict-Transport-Security")
+	if sh.HSTS != NULL && s.forceHttps() && s.aProto == "https" {
+		h.Set("Strict-Transport-Security", sh.HSTS)
+	}
+	if sh.ContentTypeOptions != NULL {
+		h.Set("X-Content-Type-Options", sh.ContentTypeOptions)
+	}
+	if sh.PermissionsPolicy != NULL {
+		h.Set("Permissions-Policy", sh.PermissionsPolicy)
+	}
+	if sh.FrameAncestors != NULL {
+		// an additional policy can only restrict the upstream one
+		h.Add("Content-Security-Policy", "frame-ancestors "+sh.FrameAncestors)
+	}
+}
+
+// rewriteHeader replaces the values of h[k] by fn, the empty results are removed.
+func rewriteHeader(h http.Header, k string, fn func(string) string) {
+	var values []string
+	for _, v := range h[k] {
+		if v = fn(v); v != NULL {
+			values = append(values, v)
+		}
+	}
+	if len(values) > 0 {
+		h[k] = values
+	} else {
+		delete(h, k)
+	}
+}
+
+// rewriteCSP maps the sources and report-uri of the policy list v,
+// the report directives are removed unless keepReport.
+func rewriteCSP(v, origin string, mapSources, keepReport bool) string {
+	var policies = strings.Split(v, ",")
+	for p, policy := range policies {
+		var directives []string
+		for _, d := range strings.Split(policy, ";") {
+			fields := strings.Fields(d)
+			if len(fields) == 0 {
+				continue
+			}
+			switch strings.ToLower(fields[0]) {
+			case "report-uri":
+				if !keepReport {
+					continue
+				}
+				var uris = []string{fields[0]}
+				for _, u := range fields[1:] {
+					if mapped := proxyUrl(u, origin); mapped != NULL {
+						uris = append(uris, mapped)
+					}
+				}
+				if len(uris) == 1 {
+					continue
+				}
+				fields = uris
+			case "report-to":
+				if !keepReport {
+					continue
+				}
+			case "sandbox", "upgrade-insecure-requests", "block-all-mixed-content":
+			default:
+				if mapSources {
+					for i := 1; i < len(fields); i++ {
+						fields[i] = cspSource(fields[i], origin)
+					}
+				}
+			}
+			directives = append(directives, strings.Join(fields, " "))
+		}
+		policies[p] = strings.Join(directives, "; ")
+	}
+	var kept = policies[:0]
+	for _, policy := range policies {
+		if policy != NULL {
+			kept = append(kept, policy)
+		}
+	}
+	return strings.Join(kept, ", ")
+}
+
+// cspSource maps a host-source of the DomainRestriction to the proxy origin.
+func cspSource(src, origin string) string {
+	if src == "*" || src[0] == '\'' || strings.HasSuffix(src, ":") {
+		// keyword, nonce, hash or scheme
+		return src
+	}
+	var rest = src
+	if i := strings.Index(src, "://"); i >= 0 {
+		rest = src[i+3:]
+	}
+	var host, path = rest, NULL
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		host, path = rest[:i], rest[i:]
+	}
+	host = canonicalHost(host)
+	wildcard := strings.HasPrefix(host, "*.")
+	if wildcard {
+		host = host[1:]
+	}
+	if host == NULL || !config.CheckDomainRestriction(host) {
+		return src
+	}
+	switch {
+	case wildcard:
+		return "'self'"
+	case host == default_host:
+		if path == NULL {
+			return "'self'"
+		}
+		return origin + path
+	default:
+		if path == NULL {
+			path = "/"
+		}
+		return origin + "/!" + host + path
+	}
+}
+
+// proxyUrl returns the absolute proxy url of the upstream u, or empty if u
+// is outside of the DomainRestriction.
+func proxyUrl(u, origin string) string {
+	uri, err := url.Parse(u)
+	if err != nil || uri.Host == NULL || !config.CheckDomainRestriction(uri.Host) {
+		return NULL
+	}
+	return origin + string(mapUrl([]byte(u)))
+}
+
+// Report-To: {"group":"x","max_age":1,"endpoints":[{"url":"https://..."}]}, {...}
+func rewriteReportTo(v, origin string) string {
+	var groups []map[string]interface{}
+	if err := json.Unmarshal([]byte("["+v+"]"), &groups); err != nil {
+		return NULL
+	}
+	var values []string
+	for _, g := range groups {
+		endpoints, _ := g["endpoints"].([]interface{})
+		var kept []interface{}
+		for _, e := range endpoints {
+			ep, _ := e.(map[string]interface{})
+			u, _ := ep["url"].(string)
+			if mapped := proxyUrl(u, origin); mapped != NULL {
+				ep["url"] = mapped
+				kept = append(kept, ep)
+			}
+		}
+		if len(kept) == 0 {
+			continue
+		}
+		g["endpoints"] = kept
+		b, _ := json.Marshal(g)
+		values = append(values, string(b))
+	}
+	return strings.Join(values, ", ")
+}
+
+// Reporting-Endpoints: default="https://...", csp="https://..."
+func rewriteReportingEndpoints(v, origin string) string {
+	var endpoints []string
+	for _, e := range strings.Split(v, ",") {
+		m := reQuotedUrl.FindStringSubmatchIndex(e)
+		if m == nil {
+			continue
+		}
+		if mapped := proxyUrl(e[m[2]:m[3]], origin); mapped != NULL {
+			endpoints = append(endpoints, strings.TrimSpace(e[:m[2]]+mapped+e[m[3]:]))
+		}
+	}
+	return strings.Join(endpoints, ", ")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRewriteCSP(t *testing.T) {
+	initTestConfig()
+	const origin = "https://px.example"
+	samples := []struct {
+		src, dst   string
+		keepReport bool
+	}{
+		{
+			"script-src 'nonce-x' 'self' https://www.google.com/xjs/ https://ssl.gstatic.com *.google.com https://example.com; object-src 'none'",
+			"script-src 'nonce-x' 'self' https://px.example/xjs/ https://px.example/!ssl.gstatic.com/ 'self' https://example.com; object-src 'none'",
+			false,
+		},
+		{
+			"img-src https: data: www.google.com; report-uri https://csp.google.com/r https://example.com/r; report-to g",
+			"img-src https: data: 'self'",
+			false,
+		},
+		{
+			"img-src www.google.com:443; report-uri https://csp.google.com/r https://example.com/r; report-to g",
+			"img-src 'self'; report-uri https://px.example/!csp.google.com/r; report-to g",
+			true,
+		},
+		{
+			"report-uri https://example.com/r, frame-ancestors 'self'",
+			"frame-ancestors 'self'",
+			true,
+		},
+	}
+	for i, sa := range samples {
+		if dst := rewriteCSP(sa.src, origin, true, sa.keepReport); dst != sa.dst {
+			t.Errorf("%d\n   dst=%s\nexpect=%s", i, dst, sa.dst)
+		}
+	}
+}
+
+func TestRewriteReporting(t *testing.T) {
+	initTestConfig()
+	const origin = "https://px.example"
+	reportTo := `{"group":"a","max_age":10,"endpoints":[{"url":"https://csp.google.com/r"},{"url":"https://example.com/r"}]}, {"group":"b","endpoints":[{"url":"https://example.com/b"}]}`
+	expected := `{"endpoints":[{"url":"https://px.example/!csp.google.com/r"}],"group":"a","max_age":10}`
+	if dst := rewriteReportTo(reportTo, origin); dst != expected {
+		t.Errorf("Report-To=%s", dst)
+	}
+	endpoints := `default="https://www.google.com/r", other="https://example.com/r"`
+	if dst := rewriteReportingEndpoints(endpoints, origin); dst != `default="https://px.example/r"` {
+		t.Errorf("Reporting-Endpoints=%s", dst)
+	}
+}
+
+func TestSecureHeaders(t *testing.T) {
+	initTestConfig()
+	config.ForceHttps = true
+	config.securityHeaders = defaultSecurityHeaders()
+	config.securityHeaders.HSTS = "max-age=60"
+	config.securityHeaders.FrameAncestors = "'none'"
+	s := &Session{aProto: "https", aHost: "px.example"}
+	h := http.Header{
+		"Content-Security-Policy":   {"report-uri /r"},
+		"Report-To":                 {`{"group":"a"}`},
+		"Nel":                       {`{"report_to":"a"}`},
+		"Strict-Transport-Security": {"max-age=1; includeSubDomains"},
+	}
+	s.secureHeaders(h)
+	if len(h) != 2 || h.Get("Strict-Transport-Security") != "max-age=60" || h.Get("Content-Security-Policy") != "frame-ancestors 'none'" {
+		t.Errorf("header=%v", h)
+	}
+}
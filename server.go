@@ -10,7 +10,6 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
@@ -21,6 +20,8 @@ var (
 	listen      string
 	pid_file    string
 	debug       bool
+	lint_rules  bool
+	check_conf  bool
 	config      *AppConfig
 	http_client *http.Client
 	reRules     *ReRules
@@ -30,24 +31,24 @@ var (
 var (
 	err30xRedirect = errors.New("redirect")
 	errNotAllowed  = errors.New("Not allowed")
+	errTooLarge    = errors.New("Request entity too large")
+)
+
+var (
+	logV int
+	dir  string
 )
 
 func init() {
-	var logV int
-	var dir string
 	flag.IntVar(&logV, "v", 1, "log verbose")
-	flag.StringVar(&listen, "l", listen, "listen address <http>,<https>")
+	flag.StringVar(&listen, "l", listen, "listen addresses <name>=<address>,... or <address>,... of the listeners in order")
 	flag.StringVar(&pid_file, "pid", pid_file, "pid file")
 	flag.StringVar(&dir, "dir", dir, "config dir")
 	flag.BoolVar(&debug, "debug", debug, "debug")
-	flag.Parse()
-
+	flag.BoolVar(&lint_rules, "lint-rules", lint_rules, "check rules.xml and exit")
+	flag.Var(&config_sets, "set", "Section.Key=value overriding config.ini, repeatable")
+	flag.BoolVar(&check_conf, "check", check_conf, "check config.ini and rules.xml, print the effective config and exit")
 	log.SetLogOutput(NULL)
-	log.SetLogVerbose(logV)
-	if dir != NULL {
-		// enter into config dir
-		abortIf(os.Chdir(dir))
-	}
 
 	http_client = &http.Client{
 		Transport:     DefaultTransport,
@@ -69,18 +70,13 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	return
 }
 
-var dialer = (&net.Dialer{
+var baseDialer = &net.Dialer{
 	Timeout:   10 * time.Second,
 	KeepAlive: 300 * time.Second,
-}).Dial
-
-var DefaultTransport http.RoundTripper = &http.Transport{
-	Proxy:               nil,
-	Dial:                dialer,
-	TLSHandshakeTimeout: 5 * time.Second,
-	MaxIdleConnsPerHost: 256,
 }
 
+var DefaultTransport http.RoundTripper = upstreamTransport{newTransport(dialUpstream)}
+
 func redirectPolicyFunc(req *http.Request, via []*http.Request) error {
 	return err30xRedirect
 }
@@ -103,30 +99,87 @@ func abortIf(e interface{}) {
 	}
 }
 
+// parse flags in main rather than init, the test binary has its own flags
+func parseFlags() {
+	flag.Parse()
+	log.SetLogVerbose(logV)
+	if dir != NULL {
+		// enter into config dir
+		abortIf(os.Chdir(dir))
+	}
+}
+
 func main() {
 	var err error
 
+	parseFlags()
+	if lint_rules {
+		os.Exit(runLintRules())
+	}
+	if check_conf {
+		os.Exit(runCheck())
+	}
+
 	err = logPidFile()
 	abortIf(err)
 	config, err = initAppConfig()
 	abortIf(err)
 	reRules, err = initReRules()
 	abortIf(err)
+	if config.cookieJar.Enabled {
+		cookieJar, err = NewCookieJar(&config.cookieJar)
+		abortIf(err)
+		closeable = append(closeable, cookieJar)
+	}
+	if config.cookieCrypto.Enabled {
+		cookieCipher, err = NewCookieCipher(config.cookieCrypto.Keys)
+		abortIf(err)
+	}
+	if config.prefDom.Pool {
+		prefDomPool = NewPrefDomPool(&config.prefDom)
+		closeable = append(closeable, prefDomPool)
+	}
+	egressPool, err = NewEgressPool(&config.egress)
+	abortIf(err)
+	if egressPool != nil {
+		http_client.Transport = egressPool
+	}
+	if config.acme.Enabled {
+		acmeManager, err = NewACMEManager(&config.acme)
+		abortIf(err)
+		closeable = append(closeable, acmeManager)
+	}
+
+	tlsManager = NewTLSManager(&config.tls)
+	closeable = append(closeable, tlsManager)
 
-	var listenAddrs = make([]string, 2)
-	copy(listenAddrs, strings.Split(listen, ","))
-	for i, s := range config.servers {
-		go startServer(s, listenAddrs[i])
+	// all listeners are open before serving, closeable isn't shared
+	for _, s := range config.servers {
+		ln := openListener(s)
+		closeable = append(closeable, ln)
+		go startServer(s, ln)
+	}
+	if acmeManager != nil {
+		// the challenges are answered by the listeners
+		acmeManager.Start()
 	}
 	waitSignal()
 }
 
-func startServer(s *AppServ, addr string) {
-	var proto = "https"
-	var ezgoo = &ezgooServer{proto[:4+s.tlType]}
-	if addr == NULL {
-		addr = s.Listen
+func openListener(s *AppServ) net.Listener {
+	ln, err := net.Listen("tcp", s.Listen)
+	abortIf(err)
+
+	if s.tlType == TL_TLS {
+		ln = tls.NewListener(ln, tlsManager.listenerConfig(s))
 	}
+	log.Infof("Listener %s listen at %s", s.Name, ln.Addr())
+	return ln
+}
+
+func startServer(s *AppServ, ln net.Listener) {
+	var proto = "https"
+	var ezgoo = &ezgooServer{proto[:4+s.tlType], s}
 
 	serv := &http.Server{
 		Handler:        ezgoo,
@@ -134,33 +187,23 @@ func startServer(s *AppServ, addr string) {
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
-	ln, err := net.Listen("tcp", addr)
-	abortIf(err)
-
-	if s.cert != nil {
-		tlsConfig := &tls.Config{Certificates: []tls.Certificate{*s.cert}}
-		ln = tls.NewListener(ln, tlsConfig)
-	}
-
-	closeable = append(closeable, ln)
 	defer ln.Close()
-
-	log.Infoln("Listen at", ln.Addr())
 	serv.Serve(&tcpKeepAliveListener{ln})
 }
 
 func waitSignal() {
-	var sigChan = make(chan os.Signal)
+	var sigChan = make(chan os.Signal, 1)
 	USR2 := syscall.Signal(12) // fake signal-USR2 for windows
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, USR2)
 
 	for sig := range sigChan {
 		switch sig {
 		case syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM:
-			log.Exitln("Terminated by", sig)
-			for _, item := range closeable {
-				item.Close()
+			// the listeners were added last, stop them before the others
+			for i := len(closeable) - 1; i >= 0; i-- {
+				closeable[i].Close()
 			}
+			log.Exitln("Terminated by", sig)
 			return
 		default:
 			log.Infoln("Ingore signal", sig)
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Lafeng/ezgoo/glog"
+)
+
+type TLSConfig struct {
+	// 1.0, 1.1, 1.2 or 1.3
+	MinVersion string
+	// comma-list of the cipher suites of TLS 1.2 and earlier, e.g.
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, empty means the defaults of go
+	CipherSuites []string
+	// comma-list in preference order, e.g. X25519, P-256
+	CurvePreferences []string
+	// the session ticket key is replaced every SessionTicketRotation and
+	// the previous SessionTicketKeys-1 keys still resume the sessions,
+	// 0 leaves the rotation to go
+	SessionTicketRotation time.Duration
+	SessionTicketKeys     int
+	// the certificate files are checked for changes every CheckInterval
+	CheckInterval time.Duration
+	// the certificates expiring within ExpiryWarning are logged daily
+	ExpiryWarning time.Duration
+
+	minVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+}
+
+func defaultTLSConfig() TLSConfig {
+	return TLSConfig{
+		MinVersion:            "1.2",
+		SessionTicketRotation: 24 * time.Hour,
+		SessionTicketKeys:     3,
+		CheckInterval:         time.Minute,
+		ExpiryWarning:         14 * 24 * time.Hour,
+	}
+}
+
+func (c *TLSConfig) init() error {
+	var y bool
+	if c.minVersion, y = tlsVersions[c.MinVersion]; !y {
+		return fmt.Errorf("TLS.MinVersion: unknown value %q", c.MinVersion)
+	}
+	var suites = make(map[string]uint16)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[cs.Name] = cs.ID
+	}
+	c.cipherSuites = nil
+	for _, name := range trimList(c.CipherSuites) {
+		id, y := suites[name]
+		if !y {
+			return fmt.Errorf("TLS.CipherSuites: unknown cipher suite %q", name)
+		}
+		c.cipherSuites = append(c.cipherSuites, id)
+	}
+	c.curves = nil
+	for _, name := range trimList(c.CurvePreferences) {
+		id, y := tlsCurves[name]
+		if !y {
+			return fmt.Errorf("TLS.CurvePreferences: unknown curve %q", name)
+		}
+		c.curves = append(c.curves, id)
+	}
+	if c.SessionTicketRotation > 0 && c.SessionTicketKeys < 1 {
+		return fmt.Errorf("TLS.SessionTicketKeys: must be positive")
+	}
+	if c.CheckInterval <= 0 {
+		c.CheckInterval = time.Minute
+	}
+	return nil
+}
+
+// TLSManager makes the tls configs of the listeners, it reloads their
+// certificates and rotates the session ticket keys of all of them.
+type TLSManager struct {
+	conf    *TLSConfig
+	mu      sync.Mutex
+	stores  []*CertStore
+	configs []*tls.Config
+	keys    [][32]byte // the newest first
+	rotated time.Time
+	stop    chan bool
+}
+
+var tlsManager *TLSManager
+
+func NewTLSManager(conf *TLSConfig) *TLSManager {
+	m := &TLSManager{conf: conf, stop: make(chan bool)}
+	go m.maintain()
+	return m
+}
+
+// listenerConfig returns the tls config of the listener s
+func (m *TLSManager) listenerConfig(s *AppServ) *tls.Config {
+	c := &tls.Config{
+		MinVersion:       m.conf.minVersion,
+		CipherSuites:     m.conf.cipherSuites,
+		CurvePreferences: m.conf.curves,
+	}
+	if s.ACME {
+		c.GetCertificate = acmeManager.GetCertificate
+		c.NextProtos = []string{"http/1.1", acmeALPNProto}
+	} else {
+		c.GetCertificate = s.certs.GetCertificate
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.certs != nil {
+		s.certs.warnExpiry(time.Now(), m.conf.ExpiryWarning)
+		m.stores = append(m.stores, s.certs)
+	}
+	m.configs = append(m.configs, c)
+	if m.conf.SessionTicketRotation > 0 {
+		if len(m.keys) == 0 {
+			m.rotateKeys(time.Now())
+		} else {
+			c.SetSessionTicketKeys(m.keys)
+		}
+	}
+	return c
+}
+
+// rotateKeys prepends a new ticket key and drops the oldest ones,
+// the caller holds mu.
+func (m *TLSManager) rotateKeys(now time.Time) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		panic(err)
+	}
+	m.keys = append([][32]byte{key}, m.keys...)
+	if len(m.keys) > m.conf.SessionTicketKeys {
+		m.keys = m.keys[:m.conf.SessionTicketKeys]
+	}
+	m.rotated = now
+	for _, c := range m.configs {
+		c.SetSessionTicketKeys(m.keys)
+	}
+	if log.V(2) {
+		log.Infoln("Rotated the session ticket keys")
+	}
+}
+
+func (m *TLSManager) check(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.stores {
+		s.reload()
+		s.warnExpiry(now, m.conf.ExpiryWarning)
+	}
+	if r := m.conf.SessionTicketRotation; r > 0 && len(m.configs) > 0 && now.Sub(m.rotated) >= r {
+		m.rotateKeys(now)
+	}
+}
+
+func (m *TLSManager) maintain() {
+	var interval = m.conf.CheckInterval
+	if r := m.conf.SessionTicketRotation; r > 0 && r < interval {
+		interval = r
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-ticker.C:
+			m.check(now)
+		}
+	}
+}
+
+func (m *TLSManager) Close() error {
+	close(m.stop)
+	return nil
+}
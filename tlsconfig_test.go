@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLSConfigInit(t *testing.T) {
+	conf := defaultTLSConfig()
+	conf.MinVersion = "1.3"
+	conf.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", " TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	conf.CurvePreferences = []string{"X25519", "P-256"}
+	if err := conf.init(); err != nil {
+		t.Fatal(err)
+	}
+	if conf.minVersion != tls.VersionTLS13 || len(conf.cipherSuites) != 2 ||
+		conf.cipherSuites[1] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || conf.curves[0] != tls.X25519 {
+		t.Errorf("conf=%+v", conf)
+	}
+
+	for _, bad := range []func(c *TLSConfig){
+		func(c *TLSConfig) { c.MinVersion = "1.4" },
+		func(c *TLSConfig) { c.CipherSuites = []string{"TLS_NONE"} },
+		func(c *TLSConfig) { c.CurvePreferences = []string{"P-224"} },
+		func(c *TLSConfig) { c.SessionTicketKeys = 0 },
+	} {
+		conf := defaultTLSConfig()
+		bad(&conf)
+		if err := conf.init(); err == nil {
+			t.Errorf("accepted %+v", conf)
+		}
+	}
+}
+
+func TestTLSManager(t *testing.T) {
+	dir, err := ioutil.TempDir(NULL, "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := writeTestCert(t, dir, "a", time.Now().Add(24*time.Hour), true, "a.example.com")
+	b := writeTestCert(t, dir, "b", time.Now().Add(24*time.Hour), true, "b.example.com")
+	serv := &AppServ{Name: "test", tlType: TL_TLS, TlsCertificates: []string{a.cert, b.cert}}
+	if serv.certs, err = serv.loadCertificates(); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := defaultTLSConfig()
+	conf.CurvePreferences = []string{"P-256"}
+	conf.SessionTicketKeys = 2
+	if err = conf.init(); err != nil {
+		t.Fatal(err)
+	}
+	m := &TLSManager{conf: &conf, stop: make(chan bool)}
+	c := m.listenerConfig(serv)
+	if c.MinVersion != tls.VersionTLS12 || len(m.keys) != 1 || len(m.stores) != 1 {
+		t.Fatalf("config=%+v keys=%d", c, len(m.keys))
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	dial := func(name string, cache tls.ClientSessionCache) tls.ConnectionState {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			ServerName:         name,
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+			ClientSessionCache: cache,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState()
+	}
+	if state := dial("b.example.com", nil); state.PeerCertificates[0].DNSNames[0] != "b.example.com" {
+		t.Errorf("SNI b served %v", state.PeerCertificates[0].DNSNames)
+	}
+
+	// the tickets of the previous key resume, those of older keys don't
+	cache := tls.NewLRUClientSessionCache(1)
+	dial("a.example.com", cache)
+	now := time.Now()
+	m.check(now.Add(conf.SessionTicketRotation))
+	if len(m.keys) != 2 {
+		t.Fatalf("keys=%d", len(m.keys))
+	}
+	if !dial("a.example.com", cache).DidResume {
+		t.Errorf("not resumed by the previous key")
+	}
+	cache = tls.NewLRUClientSessionCache(1)
+	dial("a.example.com", cache)
+	m.check(now.Add(2 * conf.SessionTicketRotation))
+	m.check(now.Add(3 * conf.SessionTicketRotation))
+	if dial("a.example.com", cache).DidResume {
+		t.Errorf("resumed by a dropped key")
+	}
+	m.check(now.Add(3*conf.SessionTicketRotation + time.Minute))
+	if len(m.keys) != 2 {
+		t.Errorf("rotated before SessionTicketRotation")
+	}
+}
+
+func TestListenerCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir(NULL, "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := writeTestCert(t, dir, "a", time.Now().Add(24*time.Hour), false, "a.example.com")
+	b := writeTestCert(t, dir, "b", time.Now().Add(24*time.Hour), true, "b.example.com")
+	serv := &AppServ{Name: "test", TlsCertificate: a.cert, TlsCertificateKey: a.key, TlsCertificates: []string{b.cert}}
+	s, err := serv.loadCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.entries) != 2 || s.entries[0].files != a {
+		t.Errorf("entries=%v", s.entries)
+	}
+	serv = &AppServ{TlsCertificates: []string{"a b c"}}
+	if _, err = serv.loadCertificates(); err == nil || !strings.Contains(err.Error(), "TlsCertificates") {
+		t.Errorf("err=%v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Lafeng/ezgoo/regexp"
+)
+
+// TransformFunc converts the text of a capture group in a replacement.
+type TransformFunc func([]byte) []byte
+
+// named functions usable in the Replacement of ReRule as ${func:group},
+// several functions are applied from left to right as ${f1|f2:group}.
+var transformFuncs = map[string]TransformFunc{
+	"urlencode":  urlEncode,
+	"urldecode":  urlDecode,
+	"base64":     base64Encode,
+	"unbase64":   base64Decode,
+	"jsescape":   jsEscape,
+	"jsunescape": jsUnescape,
+	"mapurl":     mapUrl,
+	"lower":      bytes.ToLower,
+}
+
+// ${func:group} or ${func1|func2:group}
+var reTransformRef = regexp.MustCompile(`\$\{([\w|]+):(\w+)\}`)
+
+type replPart struct {
+	template []byte // expanded as usual, may contain $1 or ${name}
+	group    int
+	funcs    []TransformFunc
+}
+
+type ReplTemplate struct {
+	parts []replPart
+}
+
+// compileReplacement parses the function references in repl.
+// Returns nil if repl is a plain template.
+func compileReplacement(re *regexp.Regexp, repl []byte) (*ReplTemplate, error) {
+	refs := reTransformRef.FindAllSubmatchIndex(repl, -1)
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	var t = new(ReplTemplate)
+	var last int
+	for _, ref := range refs {
+		var part = replPart{template: repl[last:ref[0]]}
+		for _, name := range strings.Split(string(repl[ref[2]:ref[3]]), "|") {
+			fn := transformFuncs[name]
+			if fn == nil {
+				return nil, fmt.Errorf("unknown function %q in %s", name, repl)
+			}
+			part.funcs = append(part.funcs, fn)
+		}
+		group := string(repl[ref[4]:ref[5]])
+		part.group = groupIndex(re, group)
+		if part.group < 0 {
+			return nil, fmt.Errorf("no group %q in %s", group, re)
+		}
+		t.parts = append(t.parts, part)
+		last = ref[1]
+	}
+	t.parts = append(t.parts, replPart{template: repl[last:], group: -1})
+	return t, nil
+}
+
+func groupIndex(re *regexp.Regexp, group string) int {
+	if n, err := strconv.Atoi(group); err == nil {
+		if n > re.NumSubexp() {
+			return -1
+		}
+		return n
+	}
+	for i, name := range re.SubexpNames() {
+		if i > 0 && name == group {
+			return i
+		}
+	}
+	return -1
+}
+
+// Expand appends the replacement of the match in src to dst,
+// it fits the callbacks of regexp.ReplaceAllSubmatchFunc.
+func (t *ReplTemplate) Expand(re *regexp.Regexp) func(dst, src []byte, match []int) []byte {
+	return func(dst, src []byte, match []int) []byte {
+		for _, p := range t.parts {
+			if len(p.template) > 0 {
+				dst = re.Expand(dst, p.template, src, match)
+			}
+			if p.group < 0 || match[2*p.group] < 0 {
+				continue
+			}
+			text := src[match[2*p.group]:match[2*p.group+1]]
+			for _, fn := range p.funcs {
+				text = fn(text)
+			}
+			dst = append(dst, text...)
+		}
+		return dst
+	}
+}
+
+func urlEncode(b []byte) []byte {
+	return []byte(url.QueryEscape(string(b)))
+}
+
+func urlDecode(b []byte) []byte {
+	if s, err := url.QueryUnescape(string(b)); err == nil {
+		return []byte(s)
+	}
+	return b
+}
+
+func base64Encode(b []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(b))
+}
+
+func base64Decode(b []byte) []byte {
+	if d, err := base64.StdEncoding.DecodeString(string(b)); err == nil {
+		return d
+	}
+	return b
+}
+
+// escape the way google does in json: \/ and \x3d
+func jsEscape(b []byte) []byte {
+	var buf = make([]byte, 0, len(b)+len(b)/4)
+	for _, c := range b {
+		switch c {
+		case '\\':
+			buf = append(buf, `\\`...)
+		case '/':
+			buf = append(buf, `\/`...)
+		case '\n':
+			buf = append(buf, `\n`...)
+		case '\r':
+			buf = append(buf, `\r`...)
+		case '\t':
+			buf = append(buf, `\t`...)
+		case '"', '\'', '<', '>', '&', '=':
+			buf = append(buf, fmt.Sprintf(`\x%02x`, c)...)
+		default:
+			if c < 0x20 {
+				buf = append(buf, fmt.Sprintf(`\x%02x`, c)...)
+			} else {
+				buf = append(buf, c)
+			}
+		}
+	}
+	return buf
+}
+
+func jsUnescape(b []byte) []byte {
+	if bytes.IndexByte(b, '\\') < 0 {
+		return b
+	}
+	var buf = make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c != '\\' || i+1 >= len(b) {
+			buf = append(buf, c)
+			continue
+		}
+		i++
+		switch c = b[i]; c {
+		case 'n':
+			buf = append(buf, '\n')
+		case 'r':
+			buf = append(buf, '\r')
+		case 't':
+			buf = append(buf, '\t')
+		case 'x', 'u':
+			size := 2
+			if c == 'u' {
+				size = 4
+			}
+			if i+size < len(b) {
+				if r, err := strconv.ParseUint(string(b[i+1:i+1+size]), 16, 32); err == nil {
+					var rb [utf8.UTFMax]byte
+					n := utf8.EncodeRune(rb[:], rune(r))
+					buf = append(buf, rb[:n]...)
+					i += size
+					continue
+				}
+			}
+			buf = append(buf, '\\', c)
+		default:
+			// \/ \\ \" \'
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
+
+// mapUrl maps an absolute url of the allowed domains to the proxied path
+func mapUrl(b []byte) []byte {
+	var raw = string(b)
+	if !strings.HasPrefix(raw, "//") && !strings.Contains(raw, "://") {
+		return b
+	}
+	uri, err := url.Parse(raw)
+	if err != nil {
+		return b
+	}
+	if path, ok := proxyPath(uri); ok {
+		return []byte(path)
+	}
+	return b
+}
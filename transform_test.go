@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Lafeng/ezgoo/regexp"
+)
+
+func initTestConfig() {
+	config = new(AppConfig)
+	config.domainRestrictions.Suffixes = []string{".google.com", ".gstatic.com"}
+	config.initDomainRestriction()
+}
+
+func TestTransformFuncs(t *testing.T) {
+	initTestConfig()
+	samples := []struct {
+		fn       TransformFunc
+		src, dst string
+	}{
+		{urlEncode, "a b&c=/", "a+b%26c%3D%2F"},
+		{urlDecode, "a+b%26c%3D%2F", "a b&c=/"},
+		{urlDecode, "%zz", "%zz"},
+		{base64Encode, "ezgoo", "ZXpnb28="},
+		{base64Decode, "ZXpnb28=", "ezgoo"},
+		{jsEscape, `<a href="/x?a=1">`, `\x3ca href\x3d\x22\/x?a\x3d1\x22\x3e`},
+		{jsUnescape, `\x3ca href\x3d\x22\/x?a\x3d1\x22\x3eé`, `<a href="/x?a=1">é`},
+		{jsUnescape, `\x3`, `\x3`},
+		{mapUrl, "https://www.google.com/search?q=1#f", "/search?q=1#f"},
+		{mapUrl, "https://www.google.com", "/"},
+		{mapUrl, "//ssl.gstatic.com/gb/i.png", "/!ssl.gstatic.com/gb/i.png"},
+		{mapUrl, "https://example.com/x", "https://example.com/x"},
+		{mapUrl, "/relative", "/relative"},
+	}
+	for i, sa := range samples {
+		if dst := string(sa.fn([]byte(sa.src))); dst != sa.dst {
+			t.Errorf("%d src=%s dst=%s expected=%s", i, sa.src, dst, sa.dst)
+		}
+	}
+}
+
+func TestReplTemplate(t *testing.T) {
+	initTestConfig()
+	samples := []struct {
+		pattern, repl, src, dst string
+	}{
+		{`"(https?:\\/\\/[^"]+)"`, `"${jsunescape|mapurl|jsescape:1}"`,
+			`{"u":"https:\/\/ssl.gstatic.com\/a\x3d1","v":"https:\/\/example.com\/"}`,
+			`{"u":"\/!ssl.gstatic.com\/a\x3d1","v":"https:\/\/example.com\/"}`},
+		{`(?P<k>\w+)=(?P<v>\w+)`, `$k=${lower:v}`, "A=B;C=D", "A=b;C=d"},
+		{`src=(\S+)`, `src=${urldecode:1}!`, "src=a%20b", "src=a b!"},
+	}
+	for _, sa := range samples {
+		re := regexp.MustCompile(sa.pattern)
+		tpl, err := compileReplacement(re, []byte(sa.repl))
+		if err != nil || tpl == nil {
+			t.Fatalf("repl=%s tpl=%v err=%v", sa.repl, tpl, err)
+		}
+		dst, _ := re.ReplaceAllSubmatchFunc([]byte(sa.src), tpl.Expand(re))
+		if string(dst) != sa.dst {
+			t.Errorf("repl=%s dst=%s", sa.repl, dst)
+		}
+	}
+
+	re := regexp.MustCompile(`(a)`)
+	for _, repl := range []string{"${nofunc:1}", "${lower:2}", "${lower:name}"} {
+		if _, err := compileReplacement(re, []byte(repl)); err == nil {
+			t.Errorf("repl=%s expected error", repl)
+		}
+	}
+	if tpl, err := compileReplacement(re, []byte("$1/!")); tpl != nil || err != nil {
+		t.Errorf("plain template tpl=%v err=%v", tpl, err)
+	}
+}
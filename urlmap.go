@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxyPath returns the proxy form of the absolute upstream url u,
+// false if u is outside of the DomainRestriction.
+// e.g. https://www.google.com/x -> /x and //ssl.gstatic.com/y -> /!ssl.gstatic.com/y
+func proxyPath(u *url.URL) (string, bool) {
+	if u.Host == NULL || !config.CheckDomainRestriction(u.Host) {
+		return NULL, false
+	}
+	var path = u.EscapedPath()
+	if u.Host != default_host {
+		path = "/!" + u.Host + path
+	} else if path == NULL {
+		path = "/"
+	}
+	if u.RawQuery != NULL {
+		path += "?" + u.RawQuery
+	}
+	if u.Fragment != NULL {
+		path += "#" + u.EscapedFragment()
+	}
+	return path, true
+}
+
+// UrlMapper maps the url references in the response of the upstream
+// url base to the proxy form.
+type UrlMapper struct {
+	base *url.URL
+}
+
+func NewUrlMapper(base *url.URL) *UrlMapper {
+	return &UrlMapper{base: base}
+}
+
+// Map resolves ref against the upstream url and returns its proxy form,
+// the urls outside of the DomainRestriction are returned absolute.
+// cr reports a redirection to the country site of the same path.
+func (m *UrlMapper) Map(ref string) (mapped string, cr bool) {
+	u, err := m.base.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return ref, false
+	}
+	if u.Host != m.base.Host && u.Path == m.base.Path && u.Query().Get("gfe_rd") != NULL {
+		return NULL, true
+	}
+	if mapped, ok := proxyPath(u); ok {
+		return mapped, false
+	}
+	return u.String(), false
+}
+
+// mapRefresh maps the url of Refresh: 5; url=https://...
+func (m *UrlMapper) mapRefresh(v string) string {
+	i := strings.Index(strings.ToLower(v), "url=")
+	if i < 0 {
+		return v
+	}
+	ref := strings.Trim(v[i+4:], ` '"`)
+	mapped, _ := m.Map(ref)
+	return v[:i+4] + mapped
+}
+
+// mapLink maps the targets of Link: <https://...>; rel=preload, <...>
+func (m *UrlMapper) mapLink(v string) string {
+	var buf = make([]byte, 0, len(v))
+	for {
+		i := strings.IndexByte(v, '<')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(v[i:], '>')
+		if j < 0 {
+			break
+		}
+		mapped, _ := m.Map(v[i+1 : i+j])
+		buf = append(buf, v[:i+1]...)
+		buf = append(buf, mapped...)
+		v = v[i+j:]
+	}
+	return string(append(buf, v...))
+}
+
+// mapHeaders maps the urls of the response headers h, cr reports the
+// Location of a country redirection.
+func (m *UrlMapper) mapHeaders(h http.Header) (cr bool) {
+	for i, v := range h["Location"] {
+		if h["Location"][i], cr = m.Map(v); cr {
+			return
+		}
+	}
+	for i, v := range h["Content-Location"] {
+		h["Content-Location"][i], _ = m.Map(v)
+	}
+	for i, v := range h["Refresh"] {
+		h["Refresh"][i] = m.mapRefresh(v)
+	}
+	for i, v := range h["Link"] {
+		h["Link"][i] = m.mapLink(v)
+	}
+	return
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestUrlMapper(t *testing.T) {
+	initTestConfig()
+	base, _ := url.Parse("https://ssl.gstatic.com/a/b?x=1")
+	m := NewUrlMapper(base)
+	samples := []struct {
+		ref, mapped string
+		cr          bool
+	}{
+		{"c", "/!ssl.gstatic.com/a/c", false},
+		{"/c?d#e", "/!ssl.gstatic.com/c?d#e", false},
+		{"?y=2", "/!ssl.gstatic.com/a/b?y=2", false},
+		{"//www.google.com", "/", false},
+		{"https://www.google.com/search?q=1", "/search?q=1", false},
+		{"https://example.com/x", "https://example.com/x", false},
+		{"https://ssl.gstatic.com.hk/a/b?gfe_rd=cr", NULL, true},
+		{"https://www.google.com/a/b?gfe_rd=cr&ei=1", NULL, true},
+	}
+	for _, sa := range samples {
+		if mapped, cr := m.Map(sa.ref); mapped != sa.mapped || cr != sa.cr {
+			t.Errorf("ref=%s mapped=%s cr=%v", sa.ref, mapped, cr)
+		}
+	}
+
+	h := http.Header{
+		"Location":         {"/x"},
+		"Content-Location": {"https://www.google.com/y"},
+		"Refresh":          {"0; URL='https://www.google.com/z'"},
+		"Link":             {`<https://www.gstatic.com/s.js>; rel=preload, </i.png>; rel=prefetch, <https://example.com/>`},
+	}
+	if m.mapHeaders(h) {
+		t.Errorf("unexpected cr")
+	}
+	expected := http.Header{
+		"Location":         {"/!ssl.gstatic.com/x"},
+		"Content-Location": {"/y"},
+		"Refresh":          {"0; URL=/z"},
+		"Link":             {`</!www.gstatic.com/s.js>; rel=preload, </!ssl.gstatic.com/i.png>; rel=prefetch, <https://example.com/>`},
+	}
+	for k := range expected {
+		if h.Get(k) != expected.Get(k) {
+			t.Errorf("%s: %s expected %s", k, h.Get(k), expected.Get(k))
+		}
+	}
+	if !m.mapHeaders(http.Header{"Location": {"https://www.google.co.jp/a/b?gfe_rd=cr"}}) {
+		t.Errorf("cr not detected")
+	}
+}
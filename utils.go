@@ -57,11 +57,14 @@ func dumpError(v interface{}) error {
 	return nil
 }
 
-func cookieString(ck *http.Cookie, reset_domain *string, setCookie bool) string {
+func cookieString(ck *http.Cookie, scope string, reset_domain *string, setCookie bool) string {
 	if !setCookie {
 		// inaccurate
 		return ck.Name + "=" + ck.Value
 	}
+	if cookieCipher != nil {
+		ck.Value = cookieCipher.Seal(ck.Name, scope, ck.Value)
+	}
 	if reset_domain != nil {
 		dot := strings.IndexByte(*reset_domain, '.')
 		if dot > 1 {